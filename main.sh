@@ -1,6 +1,145 @@
 #!/bin/bash
 
+## LOG_LEVEL (error, warn, info, debug or trace; -q, -v and -vv on the command
+## line) controls what is logged. Warnings and errors go to stderr, trace also
+## prints every command the script runs. When the Downward API provides
+## POD_NAME, POD_NAMESPACE and NODE_NAME, every line is prefixed with them.
+declare -A LOG_LEVELS=([error]=0 [warn]=1 [info]=2 [debug]=3 [trace]=4)
+
+log() {
+  local level=$1
+  shift
+  if (( ${LOG_LEVELS[$level]} <= ${LOG_LEVELS[${LOG_LEVEL:-info}]:-2} ))
+  then
+    if [[ -n $POD_NAME ]]
+    then
+      set -- "$(echo "$*" | sed "s|^|pod=${POD_NAMESPACE}/${POD_NAME} node=${NODE_NAME} |")"
+    fi
+    if (( ${LOG_LEVELS[$level]} <= ${LOG_LEVELS[warn]} ))
+    then
+      echo "$@" >&2
+    else
+      echo "$@"
+    fi
+  fi
+}
+
+log-error() {
+  log error "$@"
+}
+
+log-warn() {
+  log warn "$@"
+}
+
+log-info() {
+  log info "$@"
+}
+
+log-debug() {
+  log debug "$@"
+}
+
+## K8S_API_SERVER with K8S_TOKEN or K8S_TOKEN_FILE replaces the in-cluster
+## config. The token file is re-read by kubectl on every call, so short-lived
+## tokens can be rotated underneath.
+write-kubeconfig() {
+  if [[ -z $K8S_TOKEN ]] && [[ -z $K8S_TOKEN_FILE ]]
+  then
+    config-error "K8S_API_SERVER needs K8S_TOKEN or K8S_TOKEN_FILE"
+    return
+  fi
+  cat > ${WORK_DIR}/push-to-k8s${PROFILE:+-${PROFILE}}.kubeconfig <<EOF
+apiVersion: v1
+kind: Config
+clusters:
+- name: push-to-k8s
+  cluster:
+    server: ${K8S_API_SERVER}
+users:
+- name: push-to-k8s
+  user:
+$(if [[ -n $K8S_TOKEN_FILE ]]; then echo "    tokenFile: ${K8S_TOKEN_FILE}"; else echo "    token: ${K8S_TOKEN}"; fi)
+contexts:
+- name: push-to-k8s
+  context:
+    cluster: push-to-k8s
+    user: push-to-k8s
+current-context: push-to-k8s
+EOF
+}
+
+## Every kubectl call goes through here to pick up the connection settings
+## from setup (KUBECTL_ARGS).
+kubectl() {
+  command kubectl "${KUBECTL_ARGS[@]}" "$@"
+}
+
+## Problems with the settings are collected and reported together. Settings
+## with a default fall back to it with a warning, unless STRICT_CONFIG is set.
+config-error() {
+  CONFIG_ERRORS+=("$1")
+}
+
+check-setting() {
+  local name=$1
+  if [[ ! ${!name} =~ $2 ]]
+  then
+    if [[ $STRICT_CONFIG == "true" ]]
+    then
+      config-error "${name} needs to be $3"
+    else
+      log-warn "${name} needs to be $3, using $4 instead of ${!name}"
+      printf -v $name '%s' "$4"
+    fi
+  fi
+}
+
+## FEATURE_GATES=Name=true,Other=false switches behaviors that ship dark.
+## FEATURES holds every known gate with its default.
+declare -A FEATURES=([ReferenceAwareSync]=false [PushSecrets]=false)
+
+parse-feature-gates() {
+  local gate
+  local known="${!FEATURES[*]}"
+  for gate in ${FEATURE_GATES//,/ }
+  do
+    if [[ ! $gate =~ ^([A-Za-z0-9]+)=(true|false)$ ]]
+    then
+      config-error "FEATURE_GATES entries need to be in the form Name=true|false, got ${gate}"
+    elif [[ -z ${FEATURES[${BASH_REMATCH[1]}]} ]]
+    then
+      config-error "Unknown feature gate ${BASH_REMATCH[1]}, known are: ${known:-none}"
+    else
+      FEATURES[${BASH_REMATCH[1]}]=${BASH_REMATCH[2]}
+    fi
+  done
+}
+
+feature-enabled() {
+  [[ ${FEATURES[$1]} == "true" ]]
+}
+
+## The working directory and health file, all the health probe needs, so
+## probes don't validate the whole configuration or write a kubeconfig.
+setup-paths() {
+  if [[ -z $WORK_DIR ]]
+  then
+    if [[ -d /dev/shm ]] && [[ -w /dev/shm ]]
+    then
+      WORK_DIR=/dev/shm
+    else
+      WORK_DIR=/tmp
+    fi
+  fi
+  if [[ -z $HEALTH_FILE ]]
+  then
+    HEALTH_FILE=${WORK_DIR}/push-to-k8s${PROFILE:+-${PROFILE}}.health
+  fi
+}
+
 setup() {
+  CONFIG_ERRORS=()
   while getopts ":s:n:l:fh" opt; do
   case $opt in
     s)
@@ -16,8 +155,7 @@ setup() {
       help && exit 0
       ;;
     :)
-      techo "Option -$OPTARG requires an argument."
-      exit 1
+      config-error "Option -$OPTARG requires an argument."
       ;;
     *)
       help && exit 0
@@ -32,81 +170,3503 @@ setup() {
   then
     SYNCNAMESPACE="push-to-k8s"
   fi
+  if [[ -z $NEW_NAMESPACE_POLL ]]
+  then
+    NEW_NAMESPACE_POLL=5
+  fi
+  if [[ -z $FAILED_NAMESPACE_RETRIES ]]
+  then
+    FAILED_NAMESPACE_RETRIES=5
+  fi
+  if [[ -z $FAILED_NAMESPACE_BACKOFF ]]
+  then
+    FAILED_NAMESPACE_BACKOFF=10
+  fi
+  if [[ -z $SYNC_CONCURRENCY ]]
+  then
+    SYNC_CONCURRENCY=1
+  fi
+  if [[ -z $WATCH_SOURCES ]]
+  then
+    WATCH_SOURCES="true"
+  fi
+  if [[ -z $SOURCE_POLL ]]
+  then
+    SOURCE_POLL=10
+  fi
+  if [[ -z $SOURCE_SYNC_DEBOUNCE ]]
+  then
+    SOURCE_SYNC_DEBOUNCE=5
+  fi
+  if [[ -z $SOURCE_SYNC_MIN_INTERVAL ]]
+  then
+    SOURCE_SYNC_MIN_INTERVAL=30
+  fi
+  if [[ -z $NEW_NAMESPACE_RETRIES ]]
+  then
+    NEW_NAMESPACE_RETRIES=4
+  fi
+  if [[ -z $TRACK_REVISIONS ]]
+  then
+    TRACK_REVISIONS="false"
+  fi
+  if [[ -z $REVISION_HISTORY ]]
+  then
+    REVISION_HISTORY=5
+  fi
+  if [[ -z $SPREAD_WRITES ]]
+  then
+    SPREAD_WRITES="false"
+  fi
+  if [[ -z $SPREAD_JITTER ]]
+  then
+    SPREAD_JITTER=5
+  fi
+  if [[ -z $REQUIRE_APPROVAL ]]
+  then
+    REQUIRE_APPROVAL="false"
+  fi
+  if [[ -n $PROFILE ]]
+  then
+    STATUS_CONFIGMAP="push-to-k8s-status-${PROFILE}"
+    CHECKSUMS_CONFIGMAP="push-to-k8s-checksums-${PROFILE}"
+    APPROVED_SECRET="push-to-k8s-approved-${PROFILE}"
+  else
+    STATUS_CONFIGMAP="push-to-k8s-status"
+    CHECKSUMS_CONFIGMAP="push-to-k8s-checksums"
+    APPROVED_SECRET="push-to-k8s-approved"
+  fi
+  if [[ -z $SYNC_LABELS ]]
+  then
+    SYNC_LABELS="*"
+  fi
+  if [[ -z $SYNC_ANNOTATIONS ]]
+  then
+    SYNC_ANNOTATIONS="*"
+  fi
+  if [[ -z $RBAC_PREFLIGHT ]]
+  then
+    RBAC_PREFLIGHT="fail"
+  elif [[ ! $RBAC_PREFLIGHT =~ ^(fail|warn|off)$ ]]
+  then
+    config-error "Need to set the RBAC preflight to fail, warn or off"
+  fi
+  if [[ -z $ENV_LABEL ]]
+  then
+    ENV_LABEL="env"
+  fi
+  if [[ -z $SOURCE_DISCOVERY ]]
+  then
+    SOURCE_DISCOVERY="namespace"
+  elif [[ ! $SOURCE_DISCOVERY == "namespace" ]] && [[ ! $SOURCE_DISCOVERY == "cluster" ]]
+  then
+    config-error "Need to set the source discovery to namespace or cluster"
+  fi
+  if [[ -z $SOURCE_NAMESPACES ]]
+  then
+    SOURCE_NAMESPACES=$SYNCNAMESPACE
+  elif [[ ! $SOURCE_NAMESPACES =~ ^[a-z0-9-]+(,[a-z0-9-]+)*$ ]]
+  then
+    config-error "SOURCE_NAMESPACES needs to be a comma-separated list of namespaces"
+  elif [[ $SOURCE_DISCOVERY == "cluster" ]]
+  then
+    config-error "SOURCE_NAMESPACES can't be combined with SOURCE_DISCOVERY=cluster"
+  fi
+  if [[ -z $OBSERVE_ONLY ]]
+  then
+    OBSERVE_ONLY="false"
+  fi
+  if [[ -z $REPORT_DRIFT ]]
+  then
+    REPORT_DRIFT="false"
+  fi
+  if [[ -z $CANARY_SOAK ]]
+  then
+    CANARY_SOAK=300
+  fi
+  if [[ -n $CANARY_PERCENT ]] && [[ ! $CANARY_PERCENT =~ ^[0-9]+$ || $CANARY_PERCENT -gt 100 ]]
+  then
+    config-error "CANARY_PERCENT needs to be a number between 0 and 100"
+  fi
+  if [[ -n $MAX_CHANGES ]] && [[ ! $MAX_CHANGES =~ ^[0-9]+%?$ ]]
+  then
+    config-error "MAX_CHANGES needs to be a number or a percentage"
+  fi
+  if [[ -n $WRITE_WINDOW ]] && [[ ! $WRITE_WINDOW =~ ^([01][0-9]|2[0-3]):[0-5][0-9]-([01][0-9]|2[0-3]):[0-5][0-9]$ ]]
+  then
+    config-error "WRITE_WINDOW needs to be in the form HH:MM-HH:MM"
+  fi
+  if [[ -z $NAMESPACE_LABEL ]]
+  then
+    NAMESPACE_LABEL="push-to-k8s"
+  fi
   if [[ -z $LABELSELECTOR ]]
   then
     LABELSELECTOR="exclude"
   else
     if [[ ! $LABELSELECTOR == "exclude" ]] && [[ ! $LABELSELECTOR == "include" ]]
     then
-       echo "Need to set the label selector to exclude or include"
-       exit 1
+      config-error "Need to set the label selector to exclude or include"
+    fi
+  fi
+  for setting in TARGET_NAMESPACES EXCLUDE_NAMESPACES
+  do
+    if [[ -n ${!setting} ]] && [[ ! ${!setting} =~ ^[a-z0-9*?-]+(,[a-z0-9*?-]+)*$ ]]
+    then
+      config-error "${setting} needs to be a comma-separated list of namespaces or glob patterns"
+    fi
+  done
+  setup-paths
+  umask 077
+  KUBECTL_ARGS=()
+  if [[ -n $K8S_API_SERVER ]]
+  then
+    write-kubeconfig
+    KUBECTL_ARGS+=(--kubeconfig=${WORK_DIR}/push-to-k8s${PROFILE:+-${PROFILE}}.kubeconfig)
+  fi
+  if [[ -n $K8S_CA_FILE ]]
+  then
+    KUBECTL_ARGS+=(--certificate-authority=${K8S_CA_FILE})
+  fi
+  if [[ $K8S_INSECURE_SKIP_TLS_VERIFY == "true" ]]
+  then
+    if [[ -n $K8S_CA_FILE ]]
+    then
+      config-error "K8S_INSECURE_SKIP_TLS_VERIFY and K8S_CA_FILE can't be used together"
+    fi
+    log-warn "WARNING: TLS verification of the API server is disabled (K8S_INSECURE_SKIP_TLS_VERIFY), anyone in the network path can read the pushed secrets. Only use this for lab clusters"
+    KUBECTL_ARGS+=(--insecure-skip-tls-verify=true)
+  fi
+  if [[ -n $K8S_PROXY_URL ]]
+  then
+    export HTTPS_PROXY=$K8S_PROXY_URL
+  fi
+  if [[ -z $OUTPUT_MODE ]]
+  then
+    OUTPUT_MODE="namespaces"
+  elif [[ ! $OUTPUT_MODE =~ ^(namespaces|fleet)$ ]]
+  then
+    config-error "Need to set the output mode to namespaces or fleet"
+  elif [[ $OUTPUT_MODE == "fleet" ]]
+  then
+    log-warn "WARNING: The Fleet Bundle holds the secret data in plain text, anyone who can read bundles in ${FLEET_NAMESPACE:-fleet-default} can read the secrets"
+  fi
+  if [[ -z $METADATA_MERGE ]]
+  then
+    METADATA_MERGE="merge-preserve-target"
+  elif [[ ! $METADATA_MERGE =~ ^(merge-preserve-target|replace)$ ]]
+  then
+    config-error "Need to set the metadata merge to merge-preserve-target or replace"
+  fi
+  if [[ -z $APPLY_MODE ]]
+  then
+    APPLY_MODE="server"
+  elif [[ ! $APPLY_MODE =~ ^(server|client)$ ]]
+  then
+    config-error "Need to set the apply mode to server or client"
+  fi
+  APPLY_ARGS=()
+  if [[ $APPLY_MODE == "server" ]]
+  then
+    APPLY_ARGS=(--server-side --field-manager=push-to-k8s${PROFILE:+-${PROFILE}})
+  fi
+  if [[ -z $DELETE_POLICY ]]
+  then
+    DELETE_POLICY="propagate"
+  elif [[ ! $DELETE_POLICY =~ ^(propagate|orphan|retain-with-annotation)$ ]]
+  then
+    config-error "Need to set the delete policy to propagate, orphan or retain-with-annotation"
+  fi
+  if [[ -z $CONFIRM_DELETES ]]
+  then
+    CONFIRM_DELETES="true"
+  fi
+  if [[ -z $CONFLICT_POLICY ]]
+  then
+    CONFLICT_POLICY="skip"
+  elif [[ ! $CONFLICT_POLICY =~ ^(skip|adopt|overwrite|fail)$ ]]
+  then
+    config-error "Need to set the conflict policy to skip, adopt, overwrite or fail"
+  fi
+  if [[ -z $FLEET_NAMESPACE ]]
+  then
+    FLEET_NAMESPACE="fleet-default"
+  fi
+  if [[ -z $FLEET_BUNDLE ]]
+  then
+    FLEET_BUNDLE="push-to-k8s${PROFILE:+-${PROFILE}}"
+  fi
+  if [[ -z $FLEET_TARGET_NAMESPACE ]]
+  then
+    FLEET_TARGET_NAMESPACE=$SYNCNAMESPACE
+  fi
+  if [[ -z $FLEET_TARGETS ]]
+  then
+    FLEET_TARGETS='[{"clusterGroup": "default"}]'
+  elif ! echo "$FLEET_TARGETS" | jq -e 'type == "array"' > /dev/null 2>&1
+  then
+    config-error "FLEET_TARGETS needs to be a JSON list of Fleet targets"
+  fi
+  if [[ -z $HOOK_TIMEOUT ]]
+  then
+    HOOK_TIMEOUT=10
+  fi
+  if [[ -z $SHUTDOWN_TIMEOUT ]]
+  then
+    SHUTDOWN_TIMEOUT=30
+  fi
+  if [[ -z $STATSD_TAGS ]]
+  then
+    STATSD_TAGS="true"
+  fi
+  if [[ -z $BLOCK_ON_POLICY_DENIAL ]]
+  then
+    BLOCK_ON_POLICY_DENIAL="false"
+  fi
+  if [[ -z $COLLECT_SECRETS ]]
+  then
+    COLLECT_SECRETS="false"
+  fi
+  if [[ -z $COLLECT_PREFIX ]]
+  then
+    COLLECT_PREFIX="true"
+  fi
+  if [[ -z $SYNC_SYSTEM_NAMESPACES ]]
+  then
+    SYNC_SYSTEM_NAMESPACES="false"
+  fi
+  if [[ -n $STATSD_ADDRESS ]] && [[ ! $STATSD_ADDRESS =~ ^[^:]+:[0-9]+$ ]]
+  then
+    config-error "STATSD_ADDRESS needs to be in the form host:port"
+  fi
+  if [[ -z $LOG_LEVEL ]]
+  then
+    LOG_LEVEL="info"
+  elif [[ -z ${LOG_LEVELS[$LOG_LEVEL]} ]]
+  then
+    LOG_LEVEL="info"
+    config-error "Need to set the log level to error, warn, info, debug or trace"
+  fi
+  check-setting SLEEP '^[0-9]+$' "a number" 360
+  check-setting NEW_NAMESPACE_POLL '^[0-9]+$' "a number" 5
+  check-setting NEW_NAMESPACE_RETRIES '^[0-9]+$' "a number" 4
+  check-setting FAILED_NAMESPACE_RETRIES '^[0-9]+$' "a number" 5
+  check-setting FAILED_NAMESPACE_BACKOFF '^[0-9]+$' "a number" 10
+  check-setting SOURCE_POLL '^[0-9]+$' "a number" 10
+  check-setting SYNC_CONCURRENCY '^[1-9][0-9]*$' "a number above 0" 1
+  check-setting SOURCE_SYNC_DEBOUNCE '^[0-9]+$' "a number" 5
+  check-setting SOURCE_SYNC_MIN_INTERVAL '^[0-9]+$' "a number" 30
+  check-setting REVISION_HISTORY '^[0-9]+$' "a number" 5
+  check-setting SPREAD_JITTER '^[0-9]+$' "a number" 5
+  check-setting CANARY_SOAK '^[0-9]+$' "a number" 300
+  check-setting HOOK_TIMEOUT '^[0-9]+$' "a number" 10
+  check-setting ROTATION_MAX_AGE_DAYS '^[0-9]*$' "a number" ""
+  check-setting SHUTDOWN_TIMEOUT '^[0-9]+$' "a number" 30
+  check-setting TRACK_REVISIONS '^(true|false)$' "true or false" false
+  check-setting CONFIRM_DELETES '^(true|false)$' "true or false" true
+  check-setting WATCH_SOURCES '^(true|false)$' "true or false" true
+  check-setting SPREAD_WRITES '^(true|false)$' "true or false" false
+  check-setting REQUIRE_APPROVAL '^(true|false)$' "true or false" false
+  check-setting OBSERVE_ONLY '^(true|false)$' "true or false" false
+  check-setting REPORT_DRIFT '^(true|false)$' "true or false" false
+  check-setting STATSD_TAGS '^(true|false)$' "true or false" true
+  check-setting BLOCK_ON_POLICY_DENIAL '^(true|false)$' "true or false" false
+  check-setting COLLECT_SECRETS '^(true|false)$' "true or false" false
+  check-setting SYNC_SYSTEM_NAMESPACES '^(true|false)$' "true or false" false
+  check-setting COLLECT_PREFIX '^(true|false)$' "true or false" true
+  parse-feature-gates
+  IFS=',' read -ra transformers <<< "$TRANSFORMERS"
+  for transformer in "${transformers[@]}"
+  do
+    if [[ ! $transformer == exec:* ]] && ! declare -F transform-${transformer} > /dev/null
+    then
+      config-error "Unknown transformer ${transformer}"
+    fi
+  done
+  if [[ ${#CONFIG_ERRORS[@]} -gt 0 ]]
+  then
+    log-error "Invalid configuration:"
+    for error in "${CONFIG_ERRORS[@]}"
+    do
+      log-error "  ${error}"
+    done
+    exit ${CONFIG_EXIT_CODE:-1}
+  fi
+  if [[ $LOG_LEVEL == "trace" ]]
+  then
+    set -x
+  fi
+}
+
+## Everything a sync does against the API, as "scope group resource verbs".
+## Used for the startup preflight and by the rbac command.
+required-permissions() {
+  if [[ $OBSERVE_ONLY == "true" ]]
+  then
+    echo "cluster core namespaces get,list"
+    verbs="get,list"
+  else
+    echo "cluster core namespaces get,list,patch"
+    verbs="get,list,create,patch,delete"
+  fi
+  for resource in core/secrets core/configmaps networking.k8s.io/networkpolicies rbac.authorization.k8s.io/roles rbac.authorization.k8s.io/rolebindings
+  do
+    echo "cluster ${resource%/*} ${resource#*/} ${verbs}"
+  done
+  # Writing Roles and RoleBindings that grant more than the controller holds
+  # itself takes escalate and bind, and RoleBindings may refer to ClusterRoles.
+  if [[ ! $OBSERVE_ONLY == "true" ]]
+  then
+    echo "cluster rbac.authorization.k8s.io roles escalate,bind"
+    echo "cluster rbac.authorization.k8s.io clusterroles bind"
+  fi
+  if [[ $OBSERVE_ONLY == "true" ]]
+  then
+    echo "namespace core configmaps create,patch"
+    if [[ $REQUIRE_APPROVAL == "true" ]]
+    then
+      echo "namespace core secrets get,create,patch"
+    fi
+  fi
+  echo "namespace core events create"
+  if [[ $OUTPUT_MODE == "fleet" ]]
+  then
+    echo "cluster fleet.cattle.io bundles get,create,patch"
+  fi
+  if feature-enabled PushSecrets
+  then
+    for resource in pushsecrets clusterpushsecrets
+    do
+      echo "cluster push-to-k8s.support.tools ${resource} get,list"
+      echo "cluster push-to-k8s.support.tools ${resource}/status patch"
+    done
+  fi
+  if feature-enabled ReferenceAwareSync
+  then
+    echo "cluster core pods list"
+    echo "cluster core serviceaccounts list"
+  fi
+}
+
+## Checks up front that the ServiceAccount may do everything a sync needs
+## (kubectl auth can-i runs a SelfSubjectAccessReview per check), instead of
+## finding out through Forbidden errors in every namespace.
+preflight-rbac() {
+  if [[ $RBAC_PREFLIGHT == "off" ]]
+  then
+    return
+  fi
+  missing=""
+  while read scope group resource verbs
+  do
+    subresource=""
+    if [[ $resource == */* ]]
+    then
+      subresource="--subresource=${resource#*/}"
+      resource=${resource%%/*}
+    fi
+    if [[ ! $group == "core" ]]
+    then
+      resource="${resource}.${group}"
+    fi
+    if [[ $scope == "cluster" ]]
+    then
+      where="--all-namespaces"
+    else
+      where="-n ${SYNCNAMESPACE}"
+    fi
+    for verb in ${verbs//,/ }
+    do
+      kubectl auth can-i $verb $resource $subresource $where < /dev/null > /dev/null 2>&1 || missing="${missing} ${verb}:${resource}"
+    done
+  done < <(required-permissions)
+  set-status missing-permissions "${missing# }"
+  if [[ -n $missing ]]
+  then
+    log-error "CRITICAL: ServiceAccount is missing permissions:${missing}"
+    publish-status
+    if [[ $RBAC_PREFLIGHT == "fail" ]]
+    then
+      exit 3
     fi
   fi
 }
 
+## Prints the ClusterRole/Role and bindings the ServiceAccount needs.
+print-rbac() {
+  for scope in cluster namespace
+  do
+    if [[ $scope == "cluster" ]]
+    then
+      kind="ClusterRole"
+      namespace=""
+    else
+      kind="Role"
+      namespace="  namespace: ${SYNCNAMESPACE}"
+    fi
+    echo "---"
+    echo "apiVersion: rbac.authorization.k8s.io/v1"
+    echo "kind: ${kind}"
+    echo "metadata:"
+    echo "  name: push-to-k8s"
+    [[ -n $namespace ]] && echo "$namespace"
+    echo "rules:"
+    required-permissions | while read rule_scope group resource verbs
+    do
+      if [[ $rule_scope == $scope ]]
+      then
+        [[ $group == "core" ]] && group=""
+        echo "- apiGroups: [\"${group}\"]"
+        echo "  resources: [\"${resource}\"]"
+        echo "  verbs: [\"${verbs//,/\", \"}\"]"
+      fi
+    done
+    echo "---"
+    echo "apiVersion: rbac.authorization.k8s.io/v1"
+    echo "kind: ${kind}Binding"
+    echo "metadata:"
+    echo "  name: push-to-k8s"
+    [[ -n $namespace ]] && echo "$namespace"
+    echo "roleRef:"
+    echo "  apiGroup: rbac.authorization.k8s.io"
+    echo "  kind: ${kind}"
+    echo "  name: push-to-k8s"
+    echo "subjects:"
+    echo "- kind: ServiceAccount"
+    echo "  name: push-to-k8s"
+    echo "  namespace: ${SYNCNAMESPACE}"
+  done
+}
+
+## Sources and manifests hold secret data, so they are only readable by us,
+## kept in memory (/dev/shm) where available and overwritten before removal.
 setup-tmp-dir() {
-  TMPDIR=$(mktemp -d /tmp/push-to-k8s.XXX)
+  TMPDIR=$(mktemp -d ${WORK_DIR}/push-to-k8s.XXX)
   if [[ ! -d $TMPDIR ]]
   then
-    echo "CRITICAL: Creating TMPDIR"
+    log-error "CRITICAL: Creating TMPDIR"
     exit 2
   else
-    echo "Created ${TMPDIR}"
+    log-debug "Created ${TMPDIR}"
+  fi
+  mkdir -p ${TMPDIR}/source
+}
+
+setup-state-dir() {
+  STATEDIR=$(mktemp -d ${WORK_DIR}/push-to-k8s-state.XXX)
+  if [[ ! -d $STATEDIR ]]
+  then
+    log-error "CRITICAL: Creating STATEDIR"
+    exit 2
   fi
+  mkdir -p ${STATEDIR}/status ${STATEDIR}/approved ${STATEDIR}/metrics ${STATEDIR}/checksums ${STATEDIR}/counters
+}
+
+scrub-dir() {
+  if command -v shred > /dev/null
+  then
+    find $1 -type f -exec shred -u {} + 2> /dev/null
+  fi
+  rm -rf $1
 }
 
 cleanup-tmp-dir() {
-  echo "Cleaning up TMPDIR"
-  rm -rf ${TMPDIR}
+  log-debug "Cleaning up TMPDIR"
+  scrub-dir ${TMPDIR}
   if [[ -d $TMPDIR ]]
   then
-    echo "CRITICAL: TMPDIR wasn't deleted"
+    log-error "CRITICAL: TMPDIR wasn't deleted"
     exit 2
   fi
 }
 
+cleanup-state-dir() {
+  if [[ -n $TMPDIR ]] && [[ -d $TMPDIR ]]
+  then
+    scrub-dir ${TMPDIR}
+  fi
+  if [[ -n $STATEDIR ]] && [[ -d $STATEDIR ]]
+  then
+    scrub-dir ${STATEDIR}
+  fi
+}
+
+## Strips the source label and everything tied to the source object's
+## identity so the list can be applied into other namespaces. Only labels and
+## annotations matching SYNC_LABELS/SYNC_ANNOTATIONS are carried over.
+clean-source() {
+  jq --arg labels "$SYNC_LABELS" --arg annotations "$SYNC_ANNOTATIONS" --arg revisions "$TRACK_REVISIONS" '
+    def keep($patterns): with_entries(select(.key as $key | $patterns | split(",") | any(. as $pattern | if $pattern | endswith("*") then ($key | startswith($pattern | rtrimstr("*"))) else $key == $pattern end)));
+    del(.metadata) | .items[] |= (.metadata.annotations["push-to-k8s/source-namespace"] = .metadata.namespace
+      | if $revisions == "true" then .metadata.annotations["push-to-k8s/source-resource-version"] = .metadata.resourceVersion else . end
+      | del(.metadata.namespace, .metadata.uid, .metadata.resourceVersion, .metadata.creationTimestamp, .metadata.generation, .metadata.managedFields, .status, .metadata.labels["push-to-k8s"], .metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"])
+      | if .metadata.annotations["push-to-k8s/immutable"] == "true" then .immutable = true else . end
+      | .metadata.labels |= ((. // {}) | keep($labels))
+      | .metadata.annotations |= (keep($annotations + ",push-to-k8s/*")))'
+}
+
+## Sources come from SOURCE_NAMESPACES, or with SOURCE_DISCOVERY=cluster from
+## every namespace. Besides push-to-k8s=source, a label value of
+## source-<set> puts the source in a set that only goes to namespaces labeled
+## push-to-k8s/source-<set>; the set is kept as the push-to-k8s/source-set
+## annotation since the label itself is stripped.
+get-sources() {
+  if [[ $SOURCE_DISCOVERY == "cluster" ]]
+  then
+    kubectl --all-namespaces get $1 -l push-to-k8s -o json
+  else
+    for namespace in ${SOURCE_NAMESPACES//,/ }
+    do
+      kubectl -n $namespace get $1 -l push-to-k8s -o json || echo '{"failed": true}'
+    done | jq -s 'if any(.[]; .failed) then empty else {apiVersion: "v1", kind: "List", items: [.[].items[]]} end'
+  fi | jq '.items |= map(.metadata.labels["push-to-k8s"] as $value
+    | select($value == "source" or ($value | startswith("source-")))
+    | if $value == "source" then . else .metadata.annotations["push-to-k8s/source-set"] = ($value | ltrimstr("source-")) end)'
+}
+
 get-source-secret() {
-  kubectl -n $SYNCNAMESPACE get secret -l push-to-k8s=source -o yaml | grep -v 'push-to-k8s: source' | grep -v 'namespace:' | grep -v 'uid:' | grep -v 'resourceVersion:' > ${TMPDIR}/secret.yaml
+  local secrets=`get-sources secret`
+  echo "$secrets" | jq '[.items[] | {key: .metadata.name, value: .metadata.creationTimestamp}] | from_entries' > ${TMPDIR}/secret-created.json
+  echo "$secrets" | clean-source | mark-managed | mark-source > ${TMPDIR}/source/secret.json
 }
 
 get-source-configmap() {
-  kubectl -n $SYNCNAMESPACE get configmap -l push-to-k8s=source -o yaml | grep -v 'push-to-k8s: source' | grep -v 'namespace:' | grep -v 'uid:' | grep -v 'resourceVersion:' > ${TMPDIR}/configmap.yaml
+  get-sources configmap | clean-source | mark-managed | mark-source > ${TMPDIR}/source/configmap.json
 }
 
-build-source-yaml() {
-  echo "Getting source yamls..."
-  get-source-secret
-  get-source-configmap
+get-source-networkpolicy() {
+  get-sources networkpolicy | clean-source | mark-managed | mark-source > ${TMPDIR}/source/networkpolicy.json
 }
 
-get-namespaces() {
-    if [[ $LABELSELECTOR == "exclude" ]]
-    then
-      echo "Excluding namespaces using label push-to-k8s"
-      namespaces=`kubectl get namespace --selector='!push-to-k8s' -o name | awk -F '/' '{print $2}'`
-    else
-      echo "Including namespaces using label push-to-k8s"
-      namespaces=`kubectl get namespace --selector='push-to-k8s' -o name | awk -F '/' '{print $2}'`
-    fi
+## Copies carry the managed-by label so a Role or RoleBinding a tenant created
+## under the same name is never touched.
+mark-managed() {
+  jq '.items[].metadata.labels["app.kubernetes.io/managed-by"] = "push-to-k8s"'
 }
 
-setup
-while true
-do
-  setup-tmp-dir
-  build-source-yaml
-  get-namespaces
+## Next to push-to-k8s/source-namespace, copies name their source (and the
+## profile that pushed them), so copies whose source is gone can be found.
+mark-source() {
+  jq --arg profile "$PROFILE" '.items[] |= (.metadata.annotations["push-to-k8s/source-name"] = .metadata.name
+    | if $profile == "" then . else .metadata.annotations["push-to-k8s/profile"] = $profile end)'
+}
+
+get-source-role() {
+  get-sources role | clean-source | mark-managed | mark-source > ${TMPDIR}/source/role.json
+}
+
+get-source-rolebinding() {
+  get-sources rolebinding | clean-source | mark-managed | mark-source > ${TMPDIR}/source/rolebinding.json
+}
+
+## Objects labeled push-to-k8s=bootstrap form a bundle that is only applied
+## once, to namespaces created while the controller runs.
+get-bootstrap-bundle() {
+  kubectl -n $SYNCNAMESPACE get secret,configmap,networkpolicy,role,rolebinding -l push-to-k8s=bootstrap -o json | clean-source | mark-managed > ${TMPDIR}/bootstrap.json
+}
+
+## With SOURCE_DISCOVERY=cluster the same name can show up in more than one
+## namespace. Nobody wins such a conflict: the object isn't pushed until only
+## one namespace defines it.
+resolve-conflicts() {
+  for source in ${TMPDIR}/source/*.json
+  do
+    for conflict in `jq -r '.items | group_by(.metadata.name)[] | select(length > 1) | "\(.[0].kind)/\(.[0].metadata.name):\(map(.metadata.annotations["push-to-k8s/source-namespace"]) | join(","))"' $source`
+    do
+      log-warn "Source conflict, ${conflict%%:*} is defined in namespaces ${conflict#*:}, skipping it"
+      emit-event SourceConflict "${conflict%%:*} is defined in namespaces ${conflict#*:}"
+      echo ${conflict} >> ${TMPDIR}/conflicts
+    done
+    jq '.items |= (group_by(.metadata.name) | map(select(length == 1)[]))' $source > ${source}.tmp && mv ${source}.tmp $source
+  done
+  set-status conflicts "$(cat ${TMPDIR}/conflicts 2> /dev/null)"
+}
+
+## With several SOURCE_NAMESPACES the order decides: a name defined in more
+## than one of them is taken from the first one listed.
+prefer-listed-sources() {
+  for source in ${TMPDIR}/source/*.json
+  do
+    for conflict in `jq -r --arg order "$SOURCE_NAMESPACES" '($order | split(",")) as $order
+      | .items | group_by(.metadata.name)[] | select(length > 1)
+      | sort_by(.metadata.annotations["push-to-k8s/source-namespace"] as $namespace | $order | index($namespace))
+      | "\(.[0].kind)/\(.[0].metadata.name):\(map(.metadata.annotations["push-to-k8s/source-namespace"]) | join(","))"' $source`
+    do
+      winner=${conflict#*:}
+      log-info "${conflict%%:*} is defined in namespaces ${conflict#*:}, using the one from ${winner%%,*}"
+      echo ${conflict} >> ${TMPDIR}/conflicts
+    done
+    jq --arg order "$SOURCE_NAMESPACES" '($order | split(",")) as $order
+      | .items |= (group_by(.metadata.name) | map(sort_by(.metadata.annotations["push-to-k8s/source-namespace"] as $namespace | $order | index($namespace)) | .[0]))' $source > ${source}.tmp && mv ${source}.tmp $source
+  done
+  set-status conflicts "$(cat ${TMPDIR}/conflicts 2> /dev/null)"
+}
+
+## Annotates every source object with push-to-k8s/source-hash, a SHA-256 of
+## its content, so copies show which content they carry.
+content-hashes() {
+  jq -S -c '{type, immutable, data, binaryData, spec, rules, roleRef, subjects}' | while read -r payload
+  do
+    echo -n "$payload" | sha256sum | cut -d ' ' -f 1
+  done
+}
+
+hash-sources() {
+  for source in ${@:-${TMPDIR}/source/*.json}
+  do
+    hashes=`jq -c '.items[]' $source | content-hashes | jq -R . | jq -s -c .`
+    jq --argjson hashes "$hashes" '.items |= [to_entries[] | .value.metadata.annotations["push-to-k8s/source-hash"] = $hashes[.key] | .value]' $source > ${source}.tmp && mv ${source}.tmp $source
+  done
+}
+
+## Sources annotated push-to-k8s/include-keys or push-to-k8s/exclude-keys
+## (comma-separated) only carry those data keys, e.g. a CA certificate without
+## the private key next to it. This runs after signatures and validation, which
+## cover the whole source, and re-hashes it so copies compare by the projected
+## keys. A TLS or docker config secret that loses its required keys becomes
+## Opaque.
+project-keys() {
+  for source in ${TMPDIR}/source/*.json
+  do
+    if jq -e 'any(.items[].metadata.annotations // {}; has("push-to-k8s/include-keys") or has("push-to-k8s/exclude-keys"))' $source > /dev/null
+    then
+      project-source-keys < $source > ${source}.tmp && mv ${source}.tmp $source
+      hash-sources $source
+    fi
+  done
+}
+
+## The projection of a source List on stdin, shared with the report.
+project-source-keys() {
+  jq '.items |= map((.metadata.annotations // {}) as $annotations
+    | if $annotations | has("push-to-k8s/include-keys") or has("push-to-k8s/exclude-keys") then
+        ($annotations["push-to-k8s/include-keys"] | if . then split(",") | map(ltrimstr(" ") | rtrimstr(" ")) else null end) as $kept
+        | ($annotations["push-to-k8s/exclude-keys"] // "" | split(",") | map(ltrimstr(" ") | rtrimstr(" "))) as $dropped
+        | def project: if . then with_entries(select(($kept == null or (.key | IN($kept[]))) and (.key | IN($dropped[]) | not))) else . end;
+        .data |= project
+        | .binaryData |= project
+        | if (.type == "kubernetes.io/tls" and (.data // {} | has("tls.crt") and has("tls.key") | not))
+            or (.type == "kubernetes.io/dockerconfigjson" and (.data // {} | has(".dockerconfigjson") | not)) then .type = "Opaque" else . end
+      else . end)'
+}
+
+## With SIGNING_KEY_FILE every source needs a push-to-k8s/signature
+## annotation, the HMAC-SHA256 of "<Kind>/<name>:<hash>" with that key as set
+## by the sign command. The hash covers the content and the labels and
+## annotations that are pushed or route the source (target-namespaces, env,
+## source-set and the like), but not the ones the sync adds itself. Unsigned
+## or tampered sources and bootstrap objects aren't pushed.
+source-signature() {
+  echo -n "$1:$2" | openssl dgst -sha256 -hmac "$(cat $SIGNING_KEY_FILE)" | awk '{print $NF}'
+}
+
+signed-hashes() {
+  jq -S -c '{type, immutable, data, binaryData, spec, rules, roleRef, subjects,
+    labels: (.metadata.labels // {} | del(.["app.kubernetes.io/managed-by"])),
+    annotations: (.metadata.annotations // {} | del(.["push-to-k8s/signature"], .["push-to-k8s/source-hash"], .["push-to-k8s/source-name"], .["push-to-k8s/profile"], .["push-to-k8s/source-resource-version"]))}' | while read -r payload
+  do
+    echo -n "$payload" | sha256sum | cut -d ' ' -f 1
+  done
+}
+
+verify-signatures() {
+  local rejected=()
+  for source in "$@"
+  do
+    while read -r object hash signature
+    do
+      if [[ ! `source-signature $object $hash` == $signature ]]
+      then
+        rejected+=($object)
+      fi
+    done < <(paste -d ' ' <(jq -r '.items[] | "\(.kind)/\(.metadata.name)"' $source) <(jq -c '.items[]' $source | signed-hashes) <(jq -r '.items[] | .metadata.annotations["push-to-k8s/signature"] // "-"' $source))
+  done
+  if [[ ${#rejected[@]} -gt 0 ]]
+  then
+    log-error "Not pushing sources without a valid signature: ${rejected[*]}"
+    emit-event SignatureRejected "Sources without a valid signature were not pushed: ${rejected[*]}"
+    for source in "$@"
+    do
+      jq --arg rejected "${rejected[*]}" '.items |= map(select("\(.kind)/\(.metadata.name)" | IN($rejected | split(" ")[]) | not))' $source > ${source}.tmp && mv ${source}.tmp $source
+    done
+  fi
+  set-status rejected-sources "$(printf '%s\n' "${rejected[@]}")"
+}
+
+## A corrupt pull secret or certificate copied to every namespace breaks image
+## pulls and TLS cluster-wide, so typed secrets are parsed before they go out.
+secret-valid() {
+  local secret=$1
+  case `echo "$secret" | jq -r .type` in
+    kubernetes.io/dockerconfigjson)
+      echo "$secret" | jq -r '.data[".dockerconfigjson"] // ""' | base64 -d 2> /dev/null | jq -e '.auths | type == "object"' > /dev/null 2>&1
+      ;;
+    kubernetes.io/dockercfg)
+      echo "$secret" | jq -r '.data[".dockercfg"] // ""' | base64 -d 2> /dev/null | jq -e 'type == "object"' > /dev/null 2>&1
+      ;;
+    kubernetes.io/tls)
+      echo "$secret" | jq -r '.data["tls.crt"] // ""' | base64 -d 2> /dev/null | openssl x509 -noout > /dev/null 2>&1 \
+        && echo "$secret" | jq -r '.data["tls.key"] // ""' | base64 -d 2> /dev/null | openssl pkey -noout > /dev/null 2>&1
+      ;;
+  esac
+}
+
+validate-secrets() {
+  local invalid=()
+  for source in "$@"
+  do
+    while read -r secret
+    do
+      if ! secret-valid "$secret"
+      then
+        invalid+=(`echo "$secret" | jq -r '"Secret/\(.metadata.name)"'`)
+      fi
+    done < <(jq -c '.items[] | select(.kind == "Secret")' $source)
+  done
+  if [[ ${#invalid[@]} -gt 0 ]]
+  then
+    log-error "Not pushing structurally invalid secrets: ${invalid[*]}"
+    emit-event InvalidSource "Structurally invalid secrets were not pushed: ${invalid[*]}"
+    for source in "$@"
+    do
+      jq --arg invalid "${invalid[*]}" '.items |= map(select("\(.kind)/\(.metadata.name)" | IN($invalid | split(" ")[]) | not))' $source > ${source}.tmp && mv ${source}.tmp $source
+    done
+  fi
+  set-status invalid-sources "$(printf '%s\n' "${invalid[@]}")"
+}
+
+## Signs the object as the sync sees it after clean-source, so annotations
+## that change the content (e.g. push-to-k8s/immutable) and the source set of
+## its push-to-k8s label are covered. The namespace defaults to SYNCNAMESPACE.
+sign-source() {
+  local namespace=${3:-$SYNCNAMESPACE}
+  local object
+  object=`kubectl -n $namespace get $1 $2 -o json` || exit 1
+  object=`echo "$object" | jq '{apiVersion: "v1", kind: "List", items: [.
+    | (.metadata.labels["push-to-k8s"] // "") as $value
+    | if $value | startswith("source-") then .metadata.annotations["push-to-k8s/source-set"] = ($value | ltrimstr("source-")) else . end]}' | clean-source | jq -c '.items[0]'`
+  local signature=`source-signature "$(echo "$object" | jq -r '"\(.kind)/\(.metadata.name)"')" "$(echo "$object" | signed-hashes)"`
+  kubectl -n $namespace annotate $1 $2 push-to-k8s/signature=${signature} --overwrite
+}
+
+build-source-yaml() {
+  log-info "Getting source yamls..."
+  SYNC_STARTED_AT=$SECONDS
+  if [[ $WATCH_SOURCES == "true" ]]
+  then
+    SOURCE_FINGERPRINT=`source-fingerprint`
+    LAST_SOURCE_POLL=$SECONDS
+  fi
+  get-source-secret
+  get-source-configmap
+  get-source-networkpolicy
+  get-source-role
+  get-source-rolebinding
+  get-bootstrap-bundle
+  record-source-names
+  if [[ $SOURCE_DISCOVERY == "cluster" ]]
+  then
+    resolve-conflicts
+  elif [[ $SOURCE_NAMESPACES == *,* ]]
+  then
+    prefer-listed-sources
+  fi
+  hash-sources
+  if [[ -n $SIGNING_KEY_FILE ]]
+  then
+    verify-signatures ${TMPDIR}/source/*.json ${TMPDIR}/bootstrap.json
+  fi
+  validate-secrets ${TMPDIR}/source/secret.json ${TMPDIR}/bootstrap.json
+  project-keys
+  record-source-sizes
+  record-secret-ages
+}
+
+## Every labeled source, recorded before conflict resolution, signature checks
+## and validation drop any, since a source that is in conflict or fails them
+## still exists; otherwise a same-named object elsewhere would get its copies
+## collected. Empty when a source listing failed, which turns off garbage
+## collection for the cycle.
+record-source-names() {
+  rm -f ${TMPDIR}/source-names
+  for source in ${TMPDIR}/source/*.json
+  do
+    if ! jq -e '.items' $source > /dev/null 2>&1
+    then
+      return
+    fi
+  done
+  jq -r '.items[] | "\(.kind)/\(.metadata.annotations["push-to-k8s/source-namespace"])/\(.metadata.name)"' ${TMPDIR}/source/*.json > ${TMPDIR}/source-names
+}
+
+## Lists the managed copies of this controller's source namespaces and
+## profile, never PushSecret copies, as "<source exists> <retained> <namespace>
+## <kind>/<name>". Takes the kubectl namespace arguments (-A or -n <namespace>).
+managed-copies() {
+  kubectl get secret,configmap,networkpolicy,role,rolebinding "$@" -l app.kubernetes.io/managed-by=push-to-k8s -o json | jq -r \
+    --arg profile "$PROFILE" --arg discovery "$SOURCE_DISCOVERY" --arg sources "$SOURCE_NAMESPACES" --arg names "$(cat ${TMPDIR}/source-names 2> /dev/null)" '
+    .items[] | .metadata.annotations as $annotations
+    | select($annotations["push-to-k8s/source-name"] and ($annotations["push-to-k8s/push-secret"] | not) and .metadata.labels["push-to-k8s"] == null)
+    | select(($annotations["push-to-k8s/profile"] // "") == $profile)
+    | select($discovery == "cluster" or ($annotations["push-to-k8s/source-namespace"] | IN($sources | split(",")[])))
+    | ("\(.kind)/\($annotations["push-to-k8s/source-namespace"])/\($annotations["push-to-k8s/source-name"])" | IN($names | split("\n")[])) as $exists
+    | "\($exists) \($annotations["push-to-k8s/retained-at"] != null) \(.metadata.namespace) \(.kind | ascii_downcase)/\(.metadata.name)"'
+}
+
+## Handles managed copies, in any namespace, whose source no longer exists or
+## lost its push-to-k8s label, by DELETE_POLICY. Retained copies whose source
+## is back lose their annotation. With CONFIRM_DELETES, copies are only deleted
+## for sources the push-to-k8s/confirm-delete annotation on the source
+## namespace names. Like the sync it only writes within the
+## WRITE_WINDOW, not while the sync is blocked or cut short or a source change
+## waits for approval, and a removal from more namespaces than MAX_CHANGES
+## allows is held.
+collect-garbage() {
+  if [[ ! -f ${TMPDIR}/source-names ]]
+  then
+    log-warn "Listing the sources failed, skipping garbage collection"
+    return
+  fi
+  if [[ -n $BLOCKED ]] || [[ -n $SHUTDOWN_DEADLINE ]] || [[ -n `get-status pending-revision` ]] || ! in-write-window
+  then
+    return
+  fi
+  local copies=`managed-copies -A`
+  local removals=`echo "$copies" | awk '$1 == "false" && $2 == "false" {print $3, $4}'`
+  local confirmed
+  if [[ -n $removals ]] && [[ $DELETE_POLICY == "propagate" ]] && [[ $CONFIRM_DELETES == "true" ]]
+  then
+    removals=`confirmed-deletes "$removals"`
+    confirmed=$removals
+  fi
+  if [[ -n $removals ]] && removal-blocked "$removals" "garbage collection"
+  then
+    removals=""
+    confirmed=""
+  fi
+  local namespace object
+  echo "$copies" | awk '$1 == "true" && $2 == "true" {print $3, $4}' | while read -r namespace object
+  do
+    kubectl -n $namespace annotate $object push-to-k8s/retained-at- > /dev/null
+  done
+  if [[ -n $removals ]]
+  then
+    while read -r namespace object
+    do
+      remove-copy $namespace $object "its source is gone"
+    done <<< "$removals"
+  fi
+  if [[ -n $confirmed ]]
+  then
+    kubectl annotate namespace $SYNCNAMESPACE push-to-k8s/confirm-delete- > /dev/null
+  fi
+  echo "push_to_k8s_garbage_collected_total ${GARBAGE_COLLECTED:-0}" | set-metric push_to_k8s_garbage_collected_total counter "Copies deleted, orphaned or retained because their source is gone or their namespace was excluded."
+}
+
+## Prints the removals, "<namespace> <kind>/<name>" lines, whose deletion the
+## push-to-k8s/confirm-delete annotation (comma-separated kind/name) confirms.
+## The others are held, with a DeleteHeld event once per source, so deleting
+## one source doesn't silently remove it from every namespace. The annotation
+## is cleared once the confirmed copies are gone.
+confirmed-deletes() {
+  local confirmed=`kubectl get namespace $SYNCNAMESPACE -o json | jq -r '.metadata.annotations["push-to-k8s/confirm-delete"] // "" | ascii_downcase | split(",") | map(ltrimstr(" ") | rtrimstr(" "))[]'`
+  local object count
+  echo "$1" | awk 'NR == FNR {confirmed[$1]; next} $2 in confirmed' <(echo "$confirmed") -
+  for object in `echo "$1" | awk 'NR == FNR {confirmed[$1]; next} !($2 in confirmed) {print $2}' <(echo "$confirmed") - | sort -u`
+  do
+    if ! grep -qxF $object ${STATEDIR}/deletes-held 2> /dev/null
+    then
+      echo $object >> ${STATEDIR}/deletes-held
+      count=`echo "$1" | awk -v object=$object '$2 == object' | wc -l`
+      log-warn "Source ${object} is gone, holding the deletion of its ${count} copies. Confirm it with: kubectl annotate namespace ${SYNCNAMESPACE} push-to-k8s/confirm-delete=${object} --overwrite"
+      emit-event DeleteHeld "Source ${object} is gone, the deletion of its ${count} copies is held until confirmed"
+    fi
+  done
+}
+
+## A namespace that stops being selected by a targeting rule (a new exclude
+## label, a changed selector or list) loses its copies by DELETE_POLICY.
+## Namespaces skipped for being deleted or blocked by a policy keep them. The
+## namespaces are cleaned up together, so that the removal counts against
+## MAX_CHANGES as a whole; held ones stay in CLEANUP_PENDING and are tried
+## again with every check for as long as they aren't selected.
+clean-up-namespaces() {
+  local namespace rule exists retained object
+  local removals=`for namespace in $(echo "$CLEANUP_PENDING" | sort -u)
+  do
+    rule=$(awk -v namespace=$namespace '$2 == namespace {print $1}' ${STATEDIR}/namespace-rules)
+    if [[ -n $rule ]] && [[ ! $rule =~ ^(selected|terminating|policy)$ ]]
+    then
+      managed-copies -n $namespace | awk -v rule=$rule '$2 == "false" {print $3, $4, rule}'
+    fi
+  done`
+  CLEANUP_PENDING=""
+  if [[ -z $removals ]]
+  then
+    return
+  elif ! in-write-window || removal-blocked "$removals" "excluding namespaces"
+  then
+    CLEANUP_PENDING=`echo "$removals" | cut -d ' ' -f 1 | sort -u`
+    return
+  fi
+  while read -r namespace object rule
+  do
+    remove-copy $namespace $object "the namespace is excluded by the ${rule} rule"
+  done <<< "$removals"
+  echo "push_to_k8s_garbage_collected_total ${GARBAGE_COLLECTED:-0}" | set-metric push_to_k8s_garbage_collected_total counter "Copies deleted, orphaned or retained because their source is gone or their namespace was excluded."
+}
+
+## MAX_CHANGES also caps how many namespaces may lose copies at once, to
+## garbage collection or because they stopped being selected, e.g. after a
+## selector or list file was changed by mistake. A bigger removal, given as
+## "<namespace> <kind>/<name>" lines, is held until the
+## push-to-k8s/allow-mass-change annotation on the source namespace names it.
+removal-blocked() {
+  local removals=$1
+  local count=`echo "$removals" | awk 'NF {print $1}' | sort -u | wc -l`
+  if [[ -z $MAX_CHANGES ]] || (( count <= `change-limit $(echo "$KNOWN_NAMESPACES" | grep -c .)` ))
+  then
+    return 1
+  fi
+  local removal="removal-`echo "$removals" | awk '{print $1, $2}' | sort | cksum | cut -d ' ' -f 1`"
+  if [[ $removal == `kubectl get namespace $SYNCNAMESPACE -o json | jq -r '.metadata.annotations["push-to-k8s/allow-mass-change"] // ""'` ]]
+  then
+    return 1
+  fi
+  if ! grep -qxF $removal ${STATEDIR}/removals-blocked 2> /dev/null
+  then
+    echo $removal >> ${STATEDIR}/removals-blocked
+    log-error "CRITICAL: Removal blocked, ${2} would remove copies from ${count} namespaces (limit ${MAX_CHANGES}). Allow it with: kubectl annotate namespace ${SYNCNAMESPACE} push-to-k8s/allow-mass-change=${removal} --overwrite"
+    emit-event MassChangeBlocked "Removal blocked, ${2} would remove copies from ${count} namespaces (limit ${MAX_CHANGES})"
+  fi
+}
+
+## DELETE_POLICY decides what happens to a copy that is no longer wanted:
+## propagate deletes it, orphan strips the management markers and leaves it as
+## an object push-to-k8s no longer touches, and retain-with-annotation keeps it
+## managed but annotated push-to-k8s/retained-at, e.g. for forensics.
+remove-copy() {
+  local namespace=$1
+  local object=$2
+  local reason=$3
+  local result
+  case $DELETE_POLICY in
+    propagate)
+      log-info "Deleting ${object} in namespace ${namespace}, ${reason}"
+      kubectl -n $namespace delete $object > /dev/null
+      ;;
+    orphan)
+      log-info "Orphaning ${object} in namespace ${namespace}, ${reason}"
+      kubectl -n $namespace label $object app.kubernetes.io/managed-by- > /dev/null \
+        && kubectl -n $namespace annotate $object push-to-k8s/source-namespace- push-to-k8s/source-name- push-to-k8s/profile- push-to-k8s/push-secret- > /dev/null
+      ;;
+    retain-with-annotation)
+      log-info "Retaining ${object} in namespace ${namespace}, ${reason}"
+      kubectl -n $namespace annotate $object push-to-k8s/retained-at=$(date -u +%Y-%m-%dT%H:%M:%SZ) --overwrite > /dev/null
+      ;;
+  esac
+  result=$?
+  if [[ $result -eq 0 ]]
+  then
+    GARBAGE_COLLECTED=$(( ${GARBAGE_COLLECTED:-0} + 1 ))
+  fi
+  return $result
+}
+
+## The content of every source secret is dated by its source-hash: a new hash
+## restarts the clock, a secret seen for the first time counts from its
+## creation. Secrets older than ROTATION_MAX_AGE_DAYS get a warning event once
+## a day.
+record-secret-ages() {
+  local now=`date -u +%s`
+  set-status secret-ages.json "$(jq -n --argjson now $now --argjson previous "$(get-status secret-ages.json | grep . || echo '{}')" \
+    --slurpfile created ${TMPDIR}/secret-created.json --slurpfile secrets ${TMPDIR}/source/secret.json '
+    [$secrets[0].items[] | .metadata.name as $name | .metadata.annotations["push-to-k8s/source-hash"] as $hash
+      | {key: $name, value: (if $previous[$name].hash == $hash then $previous[$name]
+          elif $previous[$name] then {hash: $hash, since: ($now | todate)}
+          else {hash: $hash, since: ($created[0][$name] // ($now | todate))} end)}] | from_entries')"
+  get-status secret-ages.json | jq -r --argjson now $now 'to_entries[] | "push_to_k8s_secret_age_seconds{name=\"\(.key)\"} \($now - (.value.since | fromdate))"' \
+    | set-metric push_to_k8s_secret_age_seconds gauge "Seconds since the content of each source secret last changed."
+  if [[ $ROTATION_MAX_AGE_DAYS -gt 0 ]]
+  then
+    local today=`date -u +%F`
+    for secret in `get-status secret-ages.json | jq -r --argjson max $(( ROTATION_MAX_AGE_DAYS * 86400 )) --argjson now $now --arg today $today 'to_entries[] | select($now - (.value.since | fromdate) > $max and .value.warned != $today) | .key'`
+    do
+      log-warn "Secret ${secret} is due for rotation, its content is older than ${ROTATION_MAX_AGE_DAYS} days"
+      emit-event RotationDue "Secret ${secret} is older than ${ROTATION_MAX_AGE_DAYS} days and due for rotation"
+      set-status secret-ages.json "$(get-status secret-ages.json | jq --arg secret $secret --arg today $today '.[$secret].warned = $today')"
+    done
+  fi
+}
+
+## Every source is copied to each namespace, so its size times the number of
+## copies is roughly what the fan-out adds to etcd.
+record-source-sizes() {
+  jq -r '.items[] | "push_to_k8s_source_bytes{kind=\"\(.kind)\",name=\"\(.metadata.name)\"} \(tojson | utf8bytelength)"' ${TMPDIR}/source/*.json 2> /dev/null \
+    | set-metric push_to_k8s_source_bytes gauge "Serialized size of each source object."
+}
+
+record-bytes-written() {
+  echo "push_to_k8s_bytes_written_total `add-to-counter bytes-written $(wc -c < $1)`" | set-metric push_to_k8s_bytes_written_total counter "Bytes of manifests applied to namespaces since the start."
+}
+
+## Counters that pushes to namespaces update are kept in ${STATEDIR}/counters
+## rather than in shell variables, so pushes running in parallel
+## (SYNC_CONCURRENCY) add up instead of each counting in its own subshell.
+add-to-counter() {
+  local counter=${STATEDIR}/counters/$1
+  {
+    flock 9
+    echo $(( `get-counter $1` + $2 )) > $counter
+    cat $counter
+  } 9> ${STATEDIR}/counters.lock
+}
+
+get-counter() {
+  cat ${STATEDIR}/counters/$1 2> /dev/null || echo 0
+}
+
+emit-event() {
+  kubectl -n $SYNCNAMESPACE create -f - > /dev/null <<EOF
+apiVersion: v1
+kind: Event
+metadata:
+  generateName: push-to-k8s.
+  labels:
+    push-to-k8s/pod: "${POD_NAME}"
+involvedObject:
+  apiVersion: v1
+  kind: Namespace
+  name: ${SYNCNAMESPACE}
+reason: $1
+message: "$2"
+type: ${3:-Warning}
+source:
+  component: push-to-k8s
+  host: "${NODE_NAME}"
+reportingComponent: push-to-k8s
+reportingInstance: "${POD_NAME}"
+firstTimestamp: $(date -u +%Y-%m-%dT%H:%M:%SZ)
+lastTimestamp: $(date -u +%Y-%m-%dT%H:%M:%SZ)
+count: 1
+EOF
+}
+
+source-revision() {
+  cat ${1:-$TMPDIR/source}/*.json | sha256sum | cut -c1-12
+}
+
+## Status is published as the push-to-k8s-status ConfigMap (suffixed with the
+## profile name when running profiles) in the source namespace, one key per
+## file in ${STATEDIR}/status.
+set-status() {
+  echo -n "$2" > ${STATEDIR}/status/$1
+}
+
+restore-status() {
+  kubectl -n $SYNCNAMESPACE get configmap ${STATUS_CONFIGMAP} -o json 2> /dev/null | jq -r '.data // {} | to_entries[] | @base64' | while read entry
+  do
+    set-status "$(echo $entry | base64 -d | jq -r .key)" "$(echo $entry | base64 -d | jq -r .value)"
+  done
+  kubectl -n $SYNCNAMESPACE get configmap ${CHECKSUMS_CONFIGMAP} -o json 2> /dev/null | jq -r '.data // {} | to_entries[] | @base64' | while read entry
+  do
+    echo $entry | base64 -d | jq -r .value > ${STATEDIR}/checksums/$(echo $entry | base64 -d | jq -r .key)
+  done
+  if [[ $REQUIRE_APPROVAL == "true" ]]
+  then
+    restore-approved
+  fi
+}
+
+## The approved snapshot holds secret data, so it is kept in the
+## push-to-k8s-approved Secret rather than the status ConfigMap, one key per
+## source kind. A restarted controller keeps pushing the approved revision
+## while a change waits for approval; a snapshot that doesn't match the
+## approved-revision status is dropped.
+save-approved() {
+  kubectl -n $SYNCNAMESPACE create secret generic ${APPROVED_SECRET} --from-file=${STATEDIR}/approved/ --dry-run=client -o yaml | kubectl -n $SYNCNAMESPACE apply -f - > /dev/null \
+    || log-warn "Saving the approved revision to secret ${APPROVED_SECRET} failed"
+}
+
+restore-approved() {
+  kubectl -n $SYNCNAMESPACE get secret ${APPROVED_SECRET} -o json 2> /dev/null | jq -r '.data // {} | to_entries[] | @base64' | while read entry
+  do
+    echo $entry | base64 -d | jq -r .value | base64 -d > ${STATEDIR}/approved/$(echo $entry | base64 -d | jq -r .key)
+  done
+  if [[ -n $(ls ${STATEDIR}/approved) ]] && [[ ! `source-revision ${STATEDIR}/approved` == `get-status approved-revision` ]]
+  then
+    log-warn "The saved approved revision doesn't match the status, ignoring it"
+    rm -f ${STATEDIR}/approved/*
+  fi
+}
+
+## The push-to-k8s-checksums ConfigMap has one key per namespace with the
+## source-hash of every object last pushed there, so verification jobs can
+## attest what was distributed without reading any secret.
+record-checksums() {
+  jq -S '[.items[] | {key: "\(.kind)/\(.metadata.name)", value: .metadata.annotations["push-to-k8s/source-hash"]}] | from_entries' $2 > ${STATEDIR}/checksums/$1
+  {
+    flock 9
+    set-status synced-at.json "$(get-status synced-at.json | jq -n --arg namespace $1 --arg time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '(input? // {}) | .[$namespace] = $time')"
+  } 9> ${STATEDIR}/status.lock
+}
+
+## How many namespaces hold an up-to-date copy of each source secret,
+## according to the checksums recorded on every push.
+record-copies() {
+  jq -r '.items[] | select(.kind == "Secret") | "\(.metadata.name) \(.metadata.annotations["push-to-k8s/source-hash"])"' ${PUSHDIR}/secret.json 2> /dev/null | while read -r secret hash
+  do
+    echo "push_to_k8s_copies{secret=\"${secret}\"} $(cat ${STATEDIR}/checksums/* 2> /dev/null | jq -s --arg secret "Secret/${secret}" --arg hash $hash 'map(select(.[$secret] == $hash)) | length')"
+  done | set-metric push_to_k8s_copies gauge "Namespaces holding an up-to-date copy of each source secret."
+}
+
+get-status() {
+  cat ${STATEDIR}/status/$1 2> /dev/null
+}
+
+## The last error per failing namespace is kept under errors.json and cleared
+## by the next successful push.
+set-namespace-error() {
+  {
+    flock 9
+    set-status errors.json "$(get-status errors.json | jq -n --arg namespace $1 --arg error "$2" --arg reason "$3" --arg time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '(input? // {}) | .[$namespace] = {error: $error, time: $time} + (if $reason == "" then {} else {reason: $reason} end)')"
+  } 9> ${STATEDIR}/status.lock
+}
+
+clear-namespace-error() {
+  if [[ -n $(get-status errors.json) ]] && get-status errors.json | jq -e --arg namespace $1 'has($namespace)' > /dev/null
+  then
+    {
+      flock 9
+      set-status errors.json "$(get-status errors.json | jq --arg namespace $1 'del(.[$namespace])')"
+    } 9> ${STATEDIR}/status.lock
+  fi
+}
+
+## Metrics are kept in Prometheus text format, one file per metric family
+## (samples on stdin), and published with the status. Samples get a profile
+## label when running profiles.
+set-metric() {
+  {
+    echo "# HELP $1 $3"
+    echo "# TYPE $1 $2"
+    if [[ -n $PROFILE ]]
+    then
+      sed -E "s/^([a-zA-Z0-9_:]+)\{/\1{profile=\"${PROFILE}\",/; s/^([a-zA-Z0-9_:]+) /\1{profile=\"${PROFILE}\"} /"
+    else
+      cat
+    fi
+  } > ${STATEDIR}/metrics/$1
+}
+
+## With STATSD_ADDRESS (host:port) every sample is also sent as a gauge over
+## UDP, labels becoming DogStatsD tags or, with STATSD_TAGS=false, part of the
+## metric name for plain statsd.
+send-statsd() {
+  grep -v '^#' ${STATEDIR}/status/metrics | awk -v tags=$STATSD_TAGS '{
+    name = $1; labels = ""
+    if (match($1, /\{.*\}/)) {
+      name = substr($1, 1, RSTART - 1)
+      labels = substr($1, RSTART + 1, RLENGTH - 2)
+      gsub(/"/, "", labels)
+    }
+    if (labels == "") {
+      print name ":" $2 "|g"
+    } else if (tags == "true") {
+      gsub(/=/, ":", labels)
+      print name ":" $2 "|g|#" labels
+    } else {
+      gsub(/[^,]*=/, "", labels)
+      gsub(/,/, ".", labels)
+      print name "." labels ":" $2 "|g"
+    }
+  }' | while read sample
+  do
+    echo -n "$sample" > /dev/udp/${STATSD_ADDRESS%:*}/${STATSD_ADDRESS##*:}
+  done
+}
+
+## health.json is a snapshot of the process for support: version (checksum of
+## this script), uptime and when the full sync and the new-namespace check last
+## ran.
+record-health() {
+  local now=`date -u +%s`
+  set-status health.json "$(jq -n --arg version "$VERSION" --argjson now $now --argjson started ${STARTED_AT:-$now} --argjson uptime $SECONDS --argjson lastSync ${LAST_SYNC_AT:-null} --argjson lastPoll $(( now - SECONDS + ${LAST_NAMESPACE_POLL:-0} )) '{
+    version: $version,
+    started: ($started | todate),
+    uptimeSeconds: $uptime,
+    lastFullSync: ($lastSync | if . then todate else null end),
+    lastNamespacePoll: (if $lastPoll > $started then $lastPoll | todate else null end)}')"
+  get-status health.json > ${HEALTH_FILE}.tmp && mv ${HEALTH_FILE}.tmp ${HEALTH_FILE}
+}
+
+publish-status() {
+  record-health
+  cat ${STATEDIR}/metrics/* > ${STATEDIR}/status/metrics 2> /dev/null
+  if [[ -n $METRICS_FILE ]]
+  then
+    # The textfile collector usually runs as another user, past the umask.
+    cp ${STATEDIR}/status/metrics ${METRICS_FILE}.tmp && chmod 644 ${METRICS_FILE}.tmp && mv ${METRICS_FILE}.tmp ${METRICS_FILE}
+  fi
+  if [[ -n $STATSD_ADDRESS ]]
+  then
+    send-statsd || log-warn "Sending metrics to ${STATSD_ADDRESS} failed"
+  fi
+  kubectl -n $SYNCNAMESPACE create configmap ${STATUS_CONFIGMAP} --from-file=${STATEDIR}/status/ --dry-run=client -o yaml | kubectl -n $SYNCNAMESPACE apply -f - > /dev/null
+  kubectl -n $SYNCNAMESPACE create configmap ${CHECKSUMS_CONFIGMAP} --from-file=${STATEDIR}/checksums/ --dry-run=client -o yaml | kubectl -n $SYNCNAMESPACE apply -f - > /dev/null
+}
+
+## With REQUIRE_APPROVAL a changed source is staged and the last approved
+## revision keeps being pushed until someone sets the
+## push-to-k8s/approved-revision annotation on the source namespace.
+check-approval() {
+  PUSHDIR=${TMPDIR}/source
+  if [[ ! $REQUIRE_APPROVAL == "true" ]]
+  then
+    return
+  fi
+  revision=`source-revision`
+  approved=`kubectl get namespace $SYNCNAMESPACE -o json | jq -r '.metadata.annotations["push-to-k8s/approved-revision"] // ""'`
+  if [[ $revision == $approved ]]
+  then
+    local saved=`ls ${STATEDIR}/approved`
+    rm -f ${STATEDIR}/approved/*
+    cp ${TMPDIR}/source/*.json ${STATEDIR}/approved/
+    if [[ -z $saved ]] || [[ ! $revision == `get-status approved-revision` ]]
+    then
+      save-approved
+    fi
+    set-status approved-revision $revision
+    set-status pending-revision ""
+  else
+    log-info "Source change staged as revision ${revision}, approve with: kubectl annotate namespace ${SYNCNAMESPACE} push-to-k8s/approved-revision=${revision} --overwrite"
+    set-status pending-revision $revision
+  fi
+  PUSHDIR=${STATEDIR}/approved
+}
+
+## MAX_CHANGES caps how many namespaces a changed revision may modify in one
+## go (e.g. 50 or 10%). Anything bigger, like an accidentally wiped source, is
+## held until the push-to-k8s/allow-mass-change annotation on the source
+## namespace names the revision. Each namespace is diffed against what would be
+## rendered for it, so routing, targeting and transformers are accounted for.
+## A namespace whose copies can't be listed counts as changed.
+change-limit() {
+  if [[ $MAX_CHANGES == *% ]]
+  then
+    echo $(( $1 * ${MAX_CHANGES%\%} / 100 ))
+  else
+    echo $MAX_CHANGES
+  fi
+}
+
+check-mass-change() {
+  BLOCKED=""
+  if [[ -z $MAX_CHANGES ]] || [[ -z $(ls ${PUSHDIR}) ]]
+  then
+    return
+  fi
+  revision=`source-revision $PUSHDIR`
+  if [[ $revision == `get-status rolled-out-revision` ]]
+  then
+    return
+  fi
+  allowed=`kubectl get namespace $SYNCNAMESPACE -o json | jq -r '.metadata.annotations["push-to-k8s/allow-mass-change"] // ""'`
+  if [[ $revision == $allowed ]]
+  then
+    return
+  fi
+  changes=0
+  total=0
+  for namespace in $namespaces
+  do
+    if [[ ! $namespace == $SYNCNAMESPACE ]]
+    then
+      # Rendering and diffing every namespace can outlast the health max-age.
+      record-health
+      total=$(( total + 1 ))
+      if ! render-copies $namespace > ${TMPDIR}/rendered-${namespace}.json
+      then
+        changes=$(( changes + 1 ))
+        continue
+      fi
+      rm -f ${TMPDIR}/existing-${namespace}.json
+      kubectl -n $namespace diff "${APPLY_ARGS[@]}" -f ${TMPDIR}/rendered-${namespace}.json > /dev/null 2>&1
+      if [[ $? -eq 1 ]]
+      then
+        changes=$(( changes + 1 ))
+      fi
+    fi
+  done
+  limit=`change-limit $total`
+  if (( changes > limit ))
+  then
+    BLOCKED="revision ${revision} would change ${changes} of ${total} namespaces (limit ${MAX_CHANGES})"
+    log-error "CRITICAL: Sync blocked, ${BLOCKED}. Allow it with: kubectl annotate namespace ${SYNCNAMESPACE} push-to-k8s/allow-mass-change=${revision} --overwrite"
+    emit-event MassChangeBlocked "Sync blocked, ${BLOCKED}"
+  fi
+  set-status blocked "$BLOCKED"
+}
+
+canary-namespaces() {
+  if [[ -n $CANARY_SELECTOR ]]
+  then
+    kubectl get namespace --selector="$CANARY_SELECTOR" -o name | awk -F '/' '{print $2}' | grep -xF -f <(echo "$namespaces")
+  else
+    for namespace in $namespaces
+    do
+      if (( $(echo -n $namespace | cksum | awk '{print $1}') % 100 < CANARY_PERCENT ))
+      then
+        echo $namespace
+      fi
+    done
+  fi
+}
+
+## When the pushed revision changes, CANARY_SELECTOR or CANARY_PERCENT picks
+## namespaces that get it first. The rest only follow after CANARY_SOAK
+## seconds, so a broken credential doesn't reach every tenant at once. The
+## canaries count towards the sync summary. Outside the write window nothing
+## is pushed, so there is nothing to soak.
+canary-rollout() {
+  if [[ -z $CANARY_SELECTOR ]] && [[ -z $CANARY_PERCENT ]]
+  then
+    return
+  fi
+  if [[ -z $(ls ${PUSHDIR}) ]] || [[ -n $BLOCKED ]] || [[ `source-revision $PUSHDIR` == `get-status rolled-out-revision` ]] || ! in-write-window
+  then
+    return
+  fi
+  local canaries=`canary-namespaces`
+  log-info "Rolling out revision $(source-revision $PUSHDIR) to canary namespaces"
+  for namespace in $canaries
+  do
+    reconcile-namespace $namespace canary
+  done
+  set-status canary "soaking revision $(source-revision $PUSHDIR) until $(date -u -d "+${CANARY_SOAK} seconds" +%Y-%m-%dT%H:%M:%SZ)"
+  publish-status
+  log-info "Soaking canary namespaces for ${CANARY_SOAK} seconds"
+  wait-until $(( SECONDS + CANARY_SOAK ))
+  if [[ -n $SHUTDOWN_DEADLINE ]]
+  then
+    log-info "Shutting down during the canary soak, leaving the rollout for the next start"
+    namespaces=""
+    return
+  fi
+  set-status canary ""
+  namespaces=`echo "$namespaces" | grep -vxF -f <(echo "$canaries")`
+}
+
+## Compares the copies in a namespace against the pushed objects and records
+## every missing or outdated one in ${STATEDIR}/drift.
+check-drift() {
+  local namespace=$1
+  kubectl -n $namespace get secret,configmap,networkpolicy,role,rolebinding -o json | jq -c --arg namespace $namespace --slurpfile sources $2 '
+    (.items | map({key: "\(.kind)/\(.metadata.name)", value: .}) | from_entries) as $targets
+    | $sources[].items[]
+    | . as $source
+    | $targets["\(.kind)/\(.metadata.name)"] as $target
+    | if $target == null then "missing"
+      elif ((.metadata.labels // {}) | to_entries | any(.value != $target.metadata.labels[.key])) then "outdated"
+      elif ((.metadata.annotations // {}) | to_entries | any(.value != $target.metadata.annotations[.key])) then "outdated"
+      elif [$target.type, $target.immutable, $target.data, $target.binaryData, $target.spec, $target.rules, $target.roleRef, $target.subjects] != [.type, .immutable, .data, .binaryData, .spec, .rules, .roleRef, .subjects] then "outdated"
+      else empty end
+    | {type: ., kind: $source.kind, name: $source.metadata.name, namespace: $namespace}' >> ${STATEDIR}/drift
+}
+
+## Copies whose source is gone, or left in a namespace that isn't selected
+## anymore, are recorded as orphaned; retained copies and those in namespaces
+## skipped for being deleted or blocked by a policy are kept on purpose.
+check-orphans() {
+  if [[ ! -f ${TMPDIR}/source-names ]]
+  then
+    return
+  fi
+  managed-copies -A | jq -R -c --arg rules "$(cat ${STATEDIR}/namespace-rules 2> /dev/null)" '
+    ($rules | split("\n") | map(split(" ") | select(length > 1) | {key: .[1], value: .[0]}) | from_entries) as $rules
+    | split(" ") | . as [$exists, $retained, $namespace, $object]
+    | select($retained == "false" and ($exists == "false" or ($rules[$namespace] // "selected" | IN("selected", "terminating", "policy") | not)))
+    | {type: "orphaned",
+       kind: {secret: "Secret", configmap: "ConfigMap", networkpolicy: "NetworkPolicy", role: "Role", rolebinding: "RoleBinding"}[$object | split("/")[0]],
+       name: ($object | split("/")[1]), namespace: $namespace}' >> ${STATEDIR}/drift
+}
+
+record-drift() {
+  set-status drift.json "$(jq -s . ${STATEDIR}/drift)"
+  for type in missing outdated orphaned
+  do
+    echo "push_to_k8s_drift_total{type=\"${type}\"} $(jq -s "map(select(.type == \"${type}\")) | length" ${STATEDIR}/drift)"
+  done | set-metric push_to_k8s_drift_total gauge "Managed copies that are missing, differ from their source or are left without one."
+}
+
+## Namespaces are looked up in the list the last namespace check cached in
+## ${STATEDIR}/namespaces.json, which is at most NEW_NAMESPACE_POLL seconds
+## old, and only fetched for namespaces that aren't in it.
+namespace-json() {
+  jq -e --arg name $1 '.items[] | select(.metadata.name == $name)' ${STATEDIR}/namespaces.json 2> /dev/null || kubectl get namespace $1 -o json
+}
+
+## Drops objects that must not land in a namespace: its own sources, the
+## secrets it opts out of with the push-to-k8s/skip-secrets annotation
+## (comma-separated names), for sources annotated push-to-k8s/env,
+## namespaces whose ENV_LABEL label (or annotation) doesn't match, and
+## namespaces outside a source's own push-to-k8s/target-namespaces (names or
+## glob patterns) or push-to-k8s/target-selector (a label selector), or in
+## its push-to-k8s/exclude-namespaces, and namespaces that didn't opt into
+## the source's set.
+route-for-namespace() {
+  local namespace=$1
+  local list=`cat`
+  local target=`cat ${TMPDIR}/namespace-${namespace}.json`
+  local environment=`echo "$target" | jq -r --arg key $ENV_LABEL '.metadata.labels[$key] // .metadata.annotations[$key] // ""'`
+  local skip=`echo "$target" | jq -r '.metadata.annotations["push-to-k8s/skip-secrets"] // ""'`
+  echo "$list" | jq --arg namespace $namespace --arg environment "$environment" --arg skip "$skip" --argjson labels "$(echo "$target" | jq '.metadata.labels // {}')" '
+    def glob($patterns): . as $name | $patterns | split(",") | map(ltrimstr(" ") | rtrimstr(" ")) | any(. as $pattern | $name | test("^" + ($pattern | gsub("\\*"; ".*") | gsub("\\?"; ".")) + "$"));
+    def selects($labels): [scan("[^,(]+(?:\\([^)]*\\))?") | gsub("^\\s+|\\s+$"; "") | select(length > 0)] | all(. as $term
+      | if test("^!") then $labels | has($term[1:] | gsub("\\s"; "")) | not
+      elif test("\\s(in|notin)\\s*\\(") then capture("^(?<key>[^ ]+)\\s+(?<op>in|notin)\\s*\\((?<values>[^)]*)\\)")
+        | . as $expr | ($labels[$expr.key] | IN($expr.values | split(",")[] | gsub("\\s"; ""))) | if $expr.op == "in" then . else not end
+      elif test("!=") then split("!=") | map(ltrimstr(" ") | rtrimstr(" ")) | $labels[.[0]] != .[1]
+      elif test("=") then split("=") | map(ltrimstr(" ") | rtrimstr(" ")) | $labels[.[0]] == .[-1]
+      else $labels | has($term) end);
+    .items |= map(
+    select(.metadata.annotations["push-to-k8s/source-namespace"] != $namespace)
+    | select(.kind != "Secret" or (.metadata.name | IN($skip | split(",")[] | gsub("\\s"; "")) | not))
+    | select((.metadata.annotations["push-to-k8s/env"] // $environment) == $environment)
+    | select(.metadata.annotations["push-to-k8s/target-namespaces"] // "*" | . as $targets | $namespace | glob($targets))
+    | select(.metadata.annotations["push-to-k8s/exclude-namespaces"] // "" | . as $excluded | $namespace | glob($excluded) | not)
+    | select(.metadata.annotations["push-to-k8s/target-selector"] // "" | selects($labels))
+    | select(.metadata.annotations["push-to-k8s/source-set"] // "" | . as $set | $set == "" or ($labels | has("push-to-k8s/source-\($set)"))))'
+}
+
+## With the ReferenceAwareSync gate a secret only goes to namespaces where a
+## Pod or ServiceAccount references it, from an index of the references built
+## once per full sync. Image pull secrets always go, since the pods of a new
+## namespace can't reference them before they exist and can't start without.
+index-secret-references() {
+  kubectl get pods,serviceaccounts -A -o json | jq -r '.items[] | .metadata.namespace as $namespace
+    | if .kind == "ServiceAccount" then (.imagePullSecrets[]?.name, .secrets[]?.name)
+      else .spec | (.imagePullSecrets[]?.name, .volumes[]?.secret.secretName, .volumes[]?.projected.sources[]?.secret.name,
+        ((.containers, .initContainers, .ephemeralContainers)[]? | (.env[]?.valueFrom.secretKeyRef.name, .envFrom[]?.secretRef.name)))
+      end
+    | select(. != null) | "\($namespace) \(.)"' | sort -u > ${TMPDIR}/references
+}
+
+filter-referenced() {
+  if ! feature-enabled ReferenceAwareSync
+  then
+    cat
+    return
+  fi
+  jq --arg referenced "$(awk -v namespace=$1 '$1 == namespace {print $2}' ${TMPDIR}/references 2> /dev/null)" \
+    '.items |= map(select(.kind != "Secret" or (.type | IN("kubernetes.io/dockerconfigjson", "kubernetes.io/dockercfg")) or (.metadata.name | IN($referenced | split("\n")[]))))'
+}
+
+## With TRACK_REVISIONS each copy carries push-to-k8s/revision, bumped every
+## time its content changes, and push-to-k8s/history with the source
+## resourceVersion and hash of the last REVISION_HISTORY revisions.
+track-revisions() {
+  local namespace=$1
+  local list=`cat`
+  if [[ ! $TRACK_REVISIONS == "true" ]] || [[ `echo "$list" | jq '.items | length'` -eq 0 ]]
+  then
+    echo "$list"
+    return
+  fi
+  local existing=`jq -c '[.items[] | {key: "\(.kind)/\(.metadata.name)", value: (.metadata.annotations // {})}] | from_entries' ${TMPDIR}/existing-${namespace}.json`
+  echo "$list" | jq --argjson existing "$existing" --argjson keep $REVISION_HISTORY --arg now "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '.items |= map(
+    ($existing["\(.kind)/\(.metadata.name)"] // {}) as $current
+    | if $current["push-to-k8s/revision"] and $current["push-to-k8s/source-hash"] == .metadata.annotations["push-to-k8s/source-hash"] then
+        .metadata.annotations["push-to-k8s/revision"] = $current["push-to-k8s/revision"]
+        | .metadata.annotations["push-to-k8s/history"] = $current["push-to-k8s/history"]
+      else
+        ((($current["push-to-k8s/revision"] // "0") | tonumber) + 1) as $revision
+        | .metadata.annotations["push-to-k8s/revision"] = ($revision | tostring)
+        | .metadata.annotations["push-to-k8s/history"] = (($current["push-to-k8s/history"] // "[]" | fromjson)
+          + [{revision: $revision, resourceVersion: .metadata.annotations["push-to-k8s/source-resource-version"], hash: .metadata.annotations["push-to-k8s/source-hash"], time: $now}]
+          | .[-$keep:] | tojson)
+      end)'
+}
+
+## TRANSFORMERS is a comma-separated pipeline every object goes through on its
+## way to a namespace: built-ins are transform-<name> functions, exec:<command>
+## runs a command that gets the List on stdin (and TRANSFORM_NAMESPACE set) and
+## prints the transformed List.
+transform-for-namespace() {
+  local namespace=$1
+  local list=`cat`
+  local transformer
+  local transformers
+  IFS=',' read -ra transformers <<< "$TRANSFORMERS"
+  for transformer in "${transformers[@]}"
+  do
+    if [[ $transformer == exec:* ]]
+    then
+      list=`echo "$list" | TRANSFORM_NAMESPACE=$namespace sh -c "${transformer#exec:}"`
+    else
+      list=`echo "$list" | transform-${transformer} $namespace`
+    fi
+    if [[ $? -ne 0 ]] || ! echo "$list" | jq -e '.items' > /dev/null 2>&1
+    then
+      log-error "Transformer ${transformer} failed for namespace ${namespace}, pushing nothing there"
+      list='{"apiVersion": "v1", "kind": "List", "items": []}'
+      break
+    fi
+  done
+  echo "$list"
+}
+
+## The template transformer renders {{ .Namespace.Name }},
+## {{ .Namespace.Labels.<key> }} and {{ .Namespace.Annotations.<key> }} (or
+## {{ index .Namespace.Labels "<key>" }} for keys with dots and slashes) in
+## Secret and ConfigMap values with the target namespace. A reference that
+## can't be resolved fails the transformer.
+transform-template() {
+  jq --argjson namespace "$(cat ${TMPDIR}/namespace-${1}.json)" '
+    def render: gsub("\\{\\{-?\\s*(?<expr>.*?)\\s*-?\\}\\}"; .expr as $expr
+      | if $expr == ".Namespace.Name" then $namespace.metadata.name
+        elif $expr | test("^\\.Namespace\\.(Labels|Annotations)\\.[A-Za-z0-9_]+$") then ($expr | split(".")) as $path | $namespace.metadata[$path[2] | ascii_downcase][$path[3]]
+        elif $expr | test("^index \\.Namespace\\.(Labels|Annotations) \"[^\"]+\"$") then ($expr | capture("Namespace\\.(?<map>[A-Za-z]+) \"(?<key>[^\"]+)\"")) as $ref | $namespace.metadata[$ref.map | ascii_downcase][$ref.key]
+        else null end
+      // error("can not render {{ \($expr) }} for namespace \($namespace.metadata.name)"));
+    .items |= map(if .data == null then .
+      elif .kind == "Secret" then .data |= map_values(. as $encoded | @base64d | if test("\\{\\{") then render | @base64 else $encoded end)
+      elif .kind == "ConfigMap" then .data |= map_values(render)
+      else . end)'
+}
+
+## Builds the list of objects to apply to one namespace. kubectl applies them
+## in order, so objects with a higher push-to-k8s/priority annotation go first.
+## The namespace is looked up once, for routing and transformers alike.
+## Objects of the same name that push-to-k8s doesn't manage are handled by
+## CONFLICT_POLICY, except Roles and RoleBindings, which are always left alone.
+render-for-namespace() {
+  local namespace=$1
+  render-copies $namespace || return 1
+  for object in `cat ${TMPDIR}/adopted-${namespace}`
+  do
+    log-warn "Adopting ${object} in namespace ${namespace}, pushed by an older version of push-to-k8s"
+  done
+  for object in `cat ${TMPDIR}/conflicts-${namespace}`
+  do
+    if [[ $object == Role/* ]] || [[ $object == RoleBinding/* ]]
+    then
+      log-warn "Skipping ${object}, it isn't managed by push-to-k8s"
+      count-result skipped
+    else
+      record-conflict $namespace $object
+    fi
+  done
+  sed -i '/^\(Role\|RoleBinding\)\//d' ${TMPDIR}/conflicts-${namespace}
+}
+
+## The rendering itself, without reporting conflicts, so check-mass-change
+## can compare exactly what a sync would apply. Secrets and ConfigMaps without
+## the markers are still copies pushed by versions before them, and adopted,
+## if their last-applied configuration has the creation time but not the
+## namespace of the source they were applied from, or if they carry what
+## would be pushed anyway.
+render-copies() {
+  local namespace=$1
+  local routed=${TMPDIR}/routed-${namespace}.json
+  local unmanaged="[]"
+  local legacy="[]"
+  namespace-json $namespace > ${TMPDIR}/namespace-${namespace}.json
+  jq -s '{apiVersion: "v1", kind: "List", items: ([.[].items[]] | sort_by(-(.metadata.annotations["push-to-k8s/priority"] // "0" | tonumber? // 0)))}' ${PUSHDIR}/*.json | route-for-namespace $namespace | transform-for-namespace $namespace | filter-referenced $namespace > $routed
+  local objects=`jq -r '.items[] | "\(.kind | ascii_downcase)/\(.metadata.name)"' $routed`
+  echo '{"items": []}' > ${TMPDIR}/existing-${namespace}.json
+  if [[ -n $objects ]]
+  then
+    if ! kubectl -n $namespace get $objects --ignore-not-found -o json > ${TMPDIR}/existing-${namespace}.json
+    then
+      return 1
+    elif [[ ! -s ${TMPDIR}/existing-${namespace}.json ]]
+    then
+      echo '{"items": []}' > ${TMPDIR}/existing-${namespace}.json
+    fi
+    unmanaged=`jq -c '[.items[]
+      | select(.metadata.labels["app.kubernetes.io/managed-by"] != "push-to-k8s" and (.metadata.annotations["push-to-k8s/source-namespace"] == null or .metadata.annotations["push-to-k8s/push-secret"] != null))
+      | "\(.kind)/\(.metadata.name)"]' ${TMPDIR}/existing-${namespace}.json`
+    legacy=`jq -c --slurpfile routed $routed '($routed[0].items | map({key: "\(.kind)/\(.metadata.name)", value: .}) | from_entries) as $rendered
+      | [.items[] | "\(.kind)/\(.metadata.name)" as $object | $rendered[$object] as $copy
+        | select($copy != null and (.kind == "Secret" or .kind == "ConfigMap") and .metadata.labels["app.kubernetes.io/managed-by"] == null
+          and .metadata.annotations["push-to-k8s/source-namespace"] == null and .metadata.annotations["push-to-k8s/push-secret"] == null)
+        | select((.metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"] // "{}" | fromjson? // {} | .metadata // {} | has("creationTimestamp") and (has("namespace") | not))
+          or ({type, data, binaryData} == ($copy | {type, data, binaryData})))
+        | $object]' ${TMPDIR}/existing-${namespace}.json`
+    unmanaged=`jq -n -c --argjson unmanaged "$unmanaged" --argjson legacy "$legacy" '$unmanaged - $legacy'`
+  fi
+  echo "$legacy" | jq -r '.[]' > ${TMPDIR}/adopted-${namespace}
+  jq -r --argjson unmanaged "$unmanaged" '.items[] | "\(.kind)/\(.metadata.name)" | select(IN($unmanaged[]))' $routed > ${TMPDIR}/conflicts-${namespace}
+  jq --argjson unmanaged "$unmanaged" --arg policy $CONFLICT_POLICY '.items |= map("\(.kind)/\(.metadata.name)" as $object
+    | if $object | IN($unmanaged[]) | not then .
+      elif .kind == "Role" or .kind == "RoleBinding" or $policy == "skip" or $policy == "fail" then empty
+      elif $policy == "overwrite" then del(.metadata.labels["app.kubernetes.io/managed-by"], .metadata.annotations["push-to-k8s/source-namespace"], .metadata.annotations["push-to-k8s/source-name"], .metadata.annotations["push-to-k8s/profile"])
+      else . end)' $routed | track-revisions $namespace | hash-copies
+}
+
+## Every copy carries push-to-k8s/copy-hash, a SHA-256 of what was rendered for
+## its namespace (content, labels and annotations), next to the source-hash of
+## its source. Objects whose live copy, as fetched by name by render-copies,
+## carries the same copy-hash are left out of the apply, so a sync in steady
+## state doesn't write every copy. The data is compared as well, so a copy
+## whose data was edited in place is corrected like before.
+hash-copies() {
+  local list=`cat`
+  local hashes=`echo "$list" | jq -S -c '.items[] | {labels: .metadata.labels, annotations: .metadata.annotations, type, immutable, data, binaryData, spec, rules, roleRef, subjects}' | while read -r payload
+  do
+    echo -n "$payload" | sha256sum | cut -d ' ' -f 1
+  done | jq -R . | jq -s -c .`
+  echo "$list" | jq --argjson hashes "$hashes" '.items |= [to_entries[] | .value.metadata.annotations["push-to-k8s/copy-hash"] = $hashes[.key] | .value]'
+}
+
+drop-unchanged() {
+  local namespace=$1
+  jq --slurpfile existing ${TMPDIR}/existing-${namespace}.json '
+    ($existing[0].items | map({key: "\(.kind)/\(.metadata.name)", value: .}) | from_entries) as $live
+    | .items |= map($live["\(.kind)/\(.metadata.name)"] as $copy
+      | select($copy == null
+        or .metadata.annotations["push-to-k8s/copy-hash"] != $copy.metadata.annotations["push-to-k8s/copy-hash"]
+        or .data != $copy.data or .binaryData != $copy.binaryData))' $2
+}
+
+## An object push-to-k8s doesn't manage that has the name of a source is
+## skipped, adopted as a managed copy, overwritten but left unmanaged (so it is
+## never garbage collected), or fails the namespace, by CONFLICT_POLICY. Each
+## conflict gets an UnmanagedConflict event the first time it is seen.
+record-conflict() {
+  local namespace=$1
+  local object=$2
+  case $CONFLICT_POLICY in
+    skip) log-warn "Skipping ${object} in namespace ${namespace}, it isn't managed by push-to-k8s"; count-result skipped ;;
+    adopt) log-warn "Adopting ${object} in namespace ${namespace}, it wasn't managed by push-to-k8s" ;;
+    overwrite) log-warn "Overwriting ${object} in namespace ${namespace}, it isn't managed by push-to-k8s" ;;
+    fail) log-warn "Failing namespace ${namespace}, ${object} isn't managed by push-to-k8s" ;;
+  esac
+  if ! grep -qxF "${namespace} ${object}" ${STATEDIR}/conflicts-seen 2> /dev/null
+  then
+    echo "${namespace} ${object}" >> ${STATEDIR}/conflicts-seen
+    emit-event UnmanagedConflict "${object} in namespace ${namespace} isn't managed by push-to-k8s, conflict policy ${CONFLICT_POLICY}"
+  fi
+  echo "push_to_k8s_unmanaged_conflicts_total{policy=\"${CONFLICT_POLICY}\"} `add-to-counter unmanaged-conflicts 1`" \
+    | set-metric push_to_k8s_unmanaged_conflicts_total counter "Objects of a source's name found unmanaged in a namespace, by the conflict policy applied."
+}
+
+## With server-side apply push-to-k8s owns only the fields it sets, under the
+## push-to-k8s field manager. Fields of a copy that another manager took over
+## (e.g. someone edited it) make the apply fail with a conflict, which is
+## reported and then forced, since the copies follow their source, unless
+## CONFLICT_POLICY=fail.
+record-field-conflict() {
+  local namespace=$1
+  log-warn "Fields of copies in namespace ${namespace} are managed by someone else: $2"
+  emit-event FieldConflict "Fields of copies in namespace ${namespace} are managed by someone else: $2"
+  echo "push_to_k8s_field_conflicts_total `add-to-counter field-conflicts 1`" \
+    | set-metric push_to_k8s_field_conflicts_total counter "Server-side applies to a namespace that conflicted with another field manager."
+}
+
+## Every namespace is matched against the targeting rules in turn and the
+## first one that skips it is recorded in ${STATEDIR}/namespace-rules, so the
+## skipped namespaces can be accounted for per rule.
+SKIP_RULES="source system names label selector list terminating policy"
+
+## NAMESPACE_INCLUDE_FILE and NAMESPACE_EXCLUDE_FILE (e.g. a mounted
+## ConfigMap) hold one namespace per line, a trailing * matching a prefix. They
+## are read on every namespace listing, so edits apply without a restart.
+read-namespace-list() {
+  if [[ -n $1 ]]
+  then
+    if [[ ! -r $1 ]]
+    then
+      log-error "Failed to read namespace list $1"
+      return 1
+    fi
+    grep -v '^\s*\(#\|$\)' $1 | tr -d ' \t\r'
+  fi
+}
+
+check-namespace-lists() {
+  local sum=`cat $NAMESPACE_INCLUDE_FILE $NAMESPACE_EXCLUDE_FILE < /dev/null 2> /dev/null | cksum`
+  if [[ -n $NAMESPACE_LISTS_SUM ]] && [[ ! $sum == $NAMESPACE_LISTS_SUM ]]
+  then
+    log-info "Namespace include/exclude lists changed"
+  fi
+  NAMESPACE_LISTS_SUM=$sum
+}
+
+## Cluster and platform namespaces never get application credentials unless
+## SYNC_SYSTEM_NAMESPACES is set.
+SYSTEM_NAMESPACES="kube-system,kube-public,kube-node-lease,cattle-system,cattle-*-system,fleet-system,fleet-local,calico-system,tigera-operator"
+
+## TARGET_NAMESPACES and EXCLUDE_NAMESPACES are comma-separated names or glob
+## patterns (team-*), checked before any label so clusters without labeling
+## conventions can still scope the sync.
+## NAMESPACE_SELECTOR takes a full label selector, set-based expressions
+## included (environment in (dev,staging),!restricted). The API server
+## evaluates it. When that fails, like when a list file can't be read, the
+## namespaces aren't listed at all rather than all skipped.
+select-namespaces() {
+  if [[ -n $NAMESPACE_SELECTOR ]]
+  then
+    local selected
+    if ! selected=`kubectl get namespace -l "$NAMESPACE_SELECTOR" -o name`
+    then
+      log-error "Failed to list namespaces matching ${NAMESPACE_SELECTOR}"
+      return 1
+    fi
+    echo "$selected" | cut -d/ -f2
+  fi
+}
+
+list-namespaces() {
+  local system=$SYSTEM_NAMESPACES
+  local selected included excluded
+  if [[ $SYNC_SYSTEM_NAMESPACES == "true" ]]
+  then
+    system=""
+  fi
+  selected=`select-namespaces` || return 1
+  included=`read-namespace-list $NAMESPACE_INCLUDE_FILE` || return 1
+  excluded=`read-namespace-list $NAMESPACE_EXCLUDE_FILE` || return 1
+  if ! kubectl get namespace -o json > ${STATEDIR}/namespaces.json.new
+  then
+    log-error "Listing namespaces failed"
+    return 1
+  fi
+  mv ${STATEDIR}/namespaces.json.new ${STATEDIR}/namespaces.json
+  jq -r --arg mode $LABELSELECTOR --arg namespace_label $NAMESPACE_LABEL --arg sources "${SYNCNAMESPACE},${SOURCE_NAMESPACES}" \
+    --arg included "$included" --arg excluded "$excluded" \
+    --arg has_include "${NAMESPACE_INCLUDE_FILE:+true}" --arg has_selector "${NAMESPACE_SELECTOR:+true}" --arg selected "$selected" \
+    --arg system "$system" --arg targeted "$TARGET_NAMESPACES" --arg excluded_names "$EXCLUDE_NAMESPACES" '
+    def glob($patterns): . as $name | $patterns | split(",") | any(. as $pattern | $name | test("^" + ($pattern | gsub("\\*"; ".*") | gsub("\\?"; ".")) + "$"));
+    def listed($list): . as $name | $list | split("\n") | any(. as $pattern | if $pattern | endswith("*") then ($name | startswith($pattern | rtrimstr("*"))) else $name == $pattern end);
+    .items[]
+    | .metadata.name as $name
+    | .metadata.creationTimestamp as $created
+    | (.metadata.labels // {} | has($namespace_label)) as $labeled
+    | if $name | IN($sources | split(",")[]) then "source"
+      elif $name | glob($system) then "system"
+      elif ($name | glob($excluded_names)) or ($targeted != "" and ($name | glob($targeted) | not)) then "names"
+      elif ($mode == "exclude" and $labeled) or ($mode == "include" and ($labeled | not)) then "label"
+      elif $has_selector == "true" and ($name | IN($selected | split("\n")[]) | not) then "selector"
+      elif ($name | listed($excluded)) or ($has_include == "true" and ($name | listed($included) | not)) then "list"
+      elif .status.phase == "Terminating" then "terminating"
+      elif .metadata.annotations["push-to-k8s/blocked-by-policy"] then "policy"
+      else "selected" end
+    | "\(.) \($name) \($created)"' ${STATEDIR}/namespaces.json > ${STATEDIR}/namespace-rules.new
+  mv ${STATEDIR}/namespace-rules.new ${STATEDIR}/namespace-rules
+  awk '$1 == "selected" {print $2}' ${STATEDIR}/namespace-rules
+}
+
+record-skipped-namespaces() {
+  set-status skipped-namespaces.json "$(jq -R -s '[split("\n")[] | select(length > 0) | split(" ") | select(.[0] != "selected")] | group_by(.[0]) | map({key: .[0][0], value: map(.[1])}) | from_entries' ${STATEDIR}/namespace-rules)"
+  for rule in $SKIP_RULES
+  do
+    echo "push_to_k8s_skipped_namespaces{rule=\"${rule}\"} $(awk -v rule=$rule '$1 == rule' ${STATEDIR}/namespace-rules | wc -l)"
+  done | set-metric push_to_k8s_skipped_namespaces gauge "Namespaces skipped, by the targeting rule that skipped them."
+}
+
+get-namespaces() {
+    if [[ $LABELSELECTOR == "exclude" ]]
+    then
+      log-debug "Excluding namespaces using label ${NAMESPACE_LABEL}"
+    else
+      log-debug "Including namespaces using label ${NAMESPACE_LABEL}"
+    fi
+    if [[ -n $NAMESPACE_SELECTOR ]]
+    then
+      log-debug "Selecting namespaces matching ${NAMESPACE_SELECTOR}"
+    fi
+    check-namespace-lists
+    if ! namespaces=`list-namespaces`
+    then
+      namespaces=""
+      return 1
+    fi
+    # Namespaces that stopped being selected since the last check lose their
+    # copies the same way as those sync-new-namespaces finds.
+    if [[ ! $OBSERVE_ONLY == "true" ]] && [[ ! $OUTPUT_MODE == "fleet" ]]
+    then
+      CLEANUP_PENDING=`echo "$CLEANUP_PENDING"; echo "$KNOWN_NAMESPACES" | grep -vxF -f <(echo "$namespaces")`
+    fi
+    KNOWN_NAMESPACES=$namespaces
+    ALL_NAMESPACES=`awk '{print $2}' ${STATEDIR}/namespace-rules`
+    record-skipped-namespaces
+    for checksums in `ls ${STATEDIR}/checksums | grep -vxF -f <(echo "$namespaces")`
+    do
+      rm ${STATEDIR}/checksums/${checksums}
+    done
+    for key in errors.json synced-at.json
+    do
+      if [[ -n $(get-status $key) ]]
+      then
+        set-status $key "$(get-status $key | jq --arg namespaces "$namespaces" 'with_entries(select(.key | IN($namespaces | split("\n")[])))')"
+      fi
+    done
+    LAST_NAMESPACE_POLL=$SECONDS
+    if [[ `jq '.items | length' ${TMPDIR}/bootstrap.json` -gt 0 ]]
+    then
+      BOOTSTRAP_PENDING=`jq -r '.items[] | select(.metadata.annotations["push-to-k8s/bootstrap"] == "failed") | .metadata.name' ${STATEDIR}/namespaces.json | grep -xF -f <(echo "$namespaces")`
+    fi
+}
+
+push-to-namespace() {
+  local namespace=$1
+  log-info "Namespace: $namespace"
+  if [[ $namespace == $SYNCNAMESPACE ]]
+  then
+    log-debug "Skipping source namespace"
+  elif [[ -n $BLOCKED ]]
+  then
+    log-debug "Sync blocked, skipping"
+  elif [[ -z $(ls ${PUSHDIR}) ]]
+  then
+    log-debug "No approved source revision yet, skipping"
+  else
+    local manifest=${TMPDIR}/manifest-${namespace}.json
+    local changed=${TMPDIR}/changed-${namespace}.json
+    if ! render-for-namespace $namespace > $manifest
+    then
+      set-namespace-error $namespace "listing its copies failed"
+      return 1
+    fi
+    if [[ $OBSERVE_ONLY == "true" ]] || [[ $REPORT_DRIFT == "true" ]]
+    then
+      check-drift $namespace $manifest
+    fi
+    drop-unchanged $namespace $manifest > $changed
+    rm -f ${TMPDIR}/existing-${namespace}.json
+    if [[ $OBSERVE_ONLY == "true" ]]
+    then
+      return
+    elif [[ $CONFLICT_POLICY == "fail" ]] && [[ -s ${TMPDIR}/conflicts-${namespace} ]]
+    then
+      set-namespace-error $namespace "$(head -n 1 ${TMPDIR}/conflicts-${namespace}) exists and isn't managed by push-to-k8s" Conflict
+      return 1
+    elif [[ `jq '.items | length' $manifest` -eq 0 ]]
+    then
+      log-debug "Nothing to push"
+      record-checksums $namespace $manifest
+    elif [[ `jq '.items | length' $changed` -eq 0 ]]
+    then
+      log-debug "Copies are up to date"
+      count-result unchanged `jq '.items | length' $manifest`
+      record-checksums $namespace $manifest
+      clear-namespace-error $namespace
+    elif ! run-hook pre $namespace $manifest $changed
+    then
+      log-warn "Pre-sync hook rejected namespace: $namespace"
+      set-namespace-error $namespace "pre-sync hook rejected the push"
+      return 1
+    else
+      log-info "Pushing out YAML"
+      count-result unchanged $(( `jq '.items | length' $manifest` - `jq '.items | length' $changed` ))
+      apply-manifest $namespace $manifest $changed
+      local result=$?
+      run-hook post $namespace $manifest $changed $result || log-warn "Post-sync hook failed for namespace: $namespace"
+      return $result
+    fi
+  fi
+}
+
+## PRE_SYNC_HOOK and POST_SYNC_HOOK are either an http(s) URL that gets the
+## payload POSTed or a command that gets it on stdin. The payload names the
+## namespace and objects, never their data, each with its operation: apply for
+## the ones written, unchanged for those already up to date. A failing
+## pre-sync hook skips the namespace.
+run-hook() {
+  local phase=$1
+  local namespace=$2
+  local manifest=$3
+  local changed=$4
+  local hook
+  if [[ $phase == "pre" ]]
+  then
+    hook=$PRE_SYNC_HOOK
+  else
+    hook=$POST_SYNC_HOOK
+  fi
+  if [[ -z $hook ]]
+  then
+    return 0
+  fi
+  local payload=`jq -c --arg phase $phase --arg namespace $namespace --arg result "$5" --slurpfile changed $changed '{
+    phase: $phase,
+    namespace: $namespace,
+    operation: "apply",
+    result: (if $result == "" then null elif $result == "0" then "success" else "failure" end),
+    objects: [.items[] | {kind, name: .metadata.name}
+      | .operation = (if [.kind, .name] | IN($changed[0].items[] | [.kind, .metadata.name]) then "apply" else "unchanged" end)]}' $manifest`
+  if [[ $hook == http://* ]] || [[ $hook == https://* ]]
+  then
+    curl -sS -f -m $HOOK_TIMEOUT -H 'Content-Type: application/json' -d "$payload" $hook > /dev/null
+  else
+    echo "$payload" | HOOK_PHASE=$phase HOOK_NAMESPACE=$namespace timeout $HOOK_TIMEOUT sh -c "$hook"
+  fi
+}
+
+## A secret's type can't be changed in place, so copies whose type no longer
+## matches the source are deleted before the manifest is applied again.
+recreate-changed-types() {
+  local namespace=$1
+  for secret in `kubectl -n $namespace get secret -o json | jq -r --slurpfile sources $2 '
+    ($sources[0].items | map(select(.kind == "Secret") | {key: .metadata.name, value: (.type // "Opaque")}) | from_entries) as $types
+    | .items[] | select($types[.metadata.name] != null and $types[.metadata.name] != (.type // "Opaque")) | .metadata.name'`
+  do
+    log-info "Type of secret/${secret} changed, recreating it"
+    kubectl -n $namespace delete secret $secret
+  done
+}
+
+## Immutable copies can't be updated, only replaced. A source annotated
+## push-to-k8s/allow-recreate=true has its outdated immutable copies deleted
+## and created again; without it they are left alone and reported, since pods
+## mounting them keep the old content until they restart.
+recreate-immutable() {
+  local namespace=$1
+  kubectl -n $namespace get secret,configmap -o json | jq -r --slurpfile sources $2 '
+    ($sources[0].items | map({key: "\(.kind)/\(.metadata.name)", value: .}) | from_entries) as $wanted
+    | .items[] | select(.immutable) | $wanted["\(.kind)/\(.metadata.name)"] as $source | select($source)
+    | select([.data, .binaryData, .immutable] != [$source.data, $source.binaryData, $source.immutable])
+    | "\(.kind | ascii_downcase)/\(.metadata.name) \($source.metadata.annotations["push-to-k8s/allow-recreate"] // "false")"' | while read -r object allowed
+  do
+    if [[ $allowed == "true" ]]
+    then
+      log-info "${object} in namespace ${namespace} is immutable, recreating it"
+      kubectl -n $namespace delete $object
+    else
+      log-warn "${object} in namespace ${namespace} is immutable and outdated, annotate the source push-to-k8s/allow-recreate=true to recreate it"
+      emit-event ImmutableCopy "${object} in namespace ${namespace} is immutable and can't be updated"
+    fi
+  done
+}
+
+## kubectl apply leaves labels and annotations it didn't set alone, which keeps
+## what tooling in the namespace added to a copy. With METADATA_MERGE=replace
+## they are removed after every apply, so copies carry exactly the source's.
+replace-metadata() {
+  local namespace=$1
+  kubectl -n $namespace get secret,configmap,networkpolicy,role,rolebinding -o json | jq -r --slurpfile sources $2 '
+    ($sources[0].items | map({key: "\(.kind)/\(.metadata.name)", value: .metadata}) | from_entries) as $wanted
+    | .items[] | $wanted["\(.kind)/\(.metadata.name)"] as $metadata | select($metadata)
+    | "\(.kind | ascii_downcase)/\(.metadata.name)" as $object
+    | ((.metadata.labels // {} | keys) - ($metadata.labels // {} | keys) | select(length > 0) | "label \($object) \(map("\(.)-") | join(" "))"),
+      ((.metadata.annotations // {} | keys) - ($metadata.annotations // {} | keys) - ["kubectl.kubernetes.io/last-applied-configuration"]
+        | select(length > 0) | "annotate \($object) \(map("\(.)-") | join(" "))")' | while read -r verb object keys
+  do
+    log-info "Removing ${verb/annotate/annotation}s ${keys} from ${object} in namespace ${namespace}"
+    kubectl -n $namespace $verb $object $keys > /dev/null
+  done
+}
+
+## Writes rejected by an admission webhook (OPA, Kyverno) or a
+## ValidatingAdmissionPolicy won't pass on a retry. They are reported with
+## reason PolicyDenied and returned as POLICY_DENIED so the caller stops
+## retrying; with BLOCK_ON_POLICY_DENIAL the namespace is annotated
+## push-to-k8s/blocked-by-policy and skipped until the annotation is removed.
+POLICY_DENIED=3
+
+policy-denial() {
+  if [[ $1 =~ admission\ webhook\ \"([^\"]+)\"\ denied\ the\ request ]] || [[ $1 =~ ValidatingAdmissionPolicy\ \'([^\']+)\'.*denied\ request ]]
+  then
+    echo ${BASH_REMATCH[1]}
+  else
+    return 1
+  fi
+}
+
+handle-policy-denial() {
+  local namespace=$1
+  local policy=$2
+  log-error "Namespace ${namespace} is blocked by policy ${policy}"
+  if [[ $BLOCK_ON_POLICY_DENIAL == "true" ]]
+  then
+    kubectl annotate namespace $namespace push-to-k8s/blocked-by-policy=$policy --overwrite > /dev/null
+    emit-event BlockedByPolicy "Namespace ${namespace} is skipped, ${policy} denied the push"
+  fi
+}
+
+## A write racing another controller gets a 409 Conflict, which goes away when
+## applied again against the latest version, so it is retried a few times
+## before it counts as a failure.
+CONFLICT_RETRIES=3
+
+apply-manifest() {
+  local namespace=$1
+  local manifest=$2
+  local changes=${3:-$2}
+  local output policy
+  output=`kubectl -n $namespace apply "${APPLY_ARGS[@]}" -f $changes 2>&1`
+  local result=$?
+  for attempt in `seq 1 $CONFLICT_RETRIES`
+  do
+    if [[ $result -eq 0 ]] || ! echo "$output" | grep -q 'the object has been modified; please apply your changes to the latest version'
+    then
+      break
+    fi
+    log-debug "Conflict writing to namespace ${namespace}, retrying"
+    sleep $attempt
+    output=`kubectl -n $namespace apply "${APPLY_ARGS[@]}" -f $changes 2>&1`
+    result=$?
+  done
+  log-info "$output"
+  if [[ $result -ne 0 ]] && echo "$output" | grep -q 'Apply failed with [0-9]* conflicts\?:'
+  then
+    record-field-conflict $namespace "$(echo "$output" | grep 'Apply failed with' | tail -n 1)"
+    if [[ $CONFLICT_POLICY == "fail" ]]
+    then
+      set-namespace-error $namespace "$(echo "$output" | grep 'Apply failed with' | tail -n 1)" Conflict
+      return 1
+    fi
+    output=`kubectl -n $namespace apply "${APPLY_ARGS[@]}" --force-conflicts -f $changes 2>&1`
+    result=$?
+    log-info "$output"
+  fi
+  if [[ $result -ne 0 ]] && echo "$output" | grep -q 'type: Invalid value: .*field is immutable'
+  then
+    recreate-changed-types $namespace $manifest
+    output=`kubectl -n $namespace apply "${APPLY_ARGS[@]}" -f $changes 2>&1`
+    result=$?
+    log-info "$output"
+  fi
+  if [[ $result -ne 0 ]] && echo "$output" | grep -q 'field is immutable when `immutable` is set'
+  then
+    recreate-immutable $namespace $manifest
+    output=`kubectl -n $namespace apply "${APPLY_ARGS[@]}" -f $changes 2>&1`
+    result=$?
+    log-info "$output"
+  fi
+  count-applied "$output"
+  if [[ $result -eq 0 ]] && [[ $METADATA_MERGE == "replace" ]]
+  then
+    replace-metadata $namespace $manifest
+  fi
+  if [[ $result -eq 0 ]]
+  then
+    record-bytes-written $changes
+    record-checksums $namespace $manifest
+    clear-namespace-error $namespace
+  elif policy=`policy-denial "$output"`
+  then
+    set-namespace-error $namespace "$(echo "$output" | grep 'denied' | tail -n 1)" PolicyDenied
+    handle-policy-denial $namespace $policy
+    return $POLICY_DENIED
+  else
+    set-namespace-error $namespace "$(echo "$output" | grep -i 'error' | tail -n 1)"
+  fi
+  return $result
+}
+
+## Freshly created namespaces often reject writes for a few seconds (admission
+## webhooks, quota controllers, default ServiceAccount not there yet), so the
+## new-namespace path retries with a doubling delay.
+retry-with-backoff() {
+  local delay=1
+  for attempt in `seq 1 $NEW_NAMESPACE_RETRIES`
+  do
+    "$@"
+    local result=$?
+    if [[ $result -eq 0 ]] || [[ $result -eq $POLICY_DENIED ]]
+    then
+      return $result
+    fi
+    log-warn "Retrying in ${delay} seconds"
+    sleep $delay
+    delay=$(( delay * 2 ))
+  done
+  "$@"
+}
+
+apply-bootstrap() {
+  local output policy
+  if output=`kubectl -n $1 apply "${APPLY_ARGS[@]}" -f ${TMPDIR}/bootstrap-${1}.json 2>&1`
+  then
+    log-info "$output"
+  elif policy=`policy-denial "$output"`
+  then
+    set-namespace-error $1 "bootstrap bundle: $(echo "$output" | grep 'denied' | tail -n 1)" PolicyDenied
+    handle-policy-denial $1 $policy
+    return $POLICY_DENIED
+  else
+    log-warn "$output"
+    return 1
+  fi
+}
+
+## The bundle is applied with a single kubectl apply, which isn't atomic:
+## objects that went through stay when others fail. The namespace is annotated
+## push-to-k8s/bootstrap=complete only if all of it went through; failed
+## bundles are applied again, whole, on every new-namespace check.
+bootstrap-namespace() {
+  local namespace=$1
+  if [[ $namespace == $SYNCNAMESPACE ]] || [[ $OBSERVE_ONLY == "true" ]] || [[ `jq '.items | length' ${TMPDIR}/bootstrap.json` -eq 0 ]]
+  then
+    return
+  fi
+  log-info "Applying bootstrap bundle to namespace: $namespace"
+  BOOTSTRAP_PENDING=`echo "$BOOTSTRAP_PENDING" | grep -vxF $namespace`
+  route-for-namespace $namespace < ${TMPDIR}/bootstrap.json > ${TMPDIR}/bootstrap-${namespace}.json
+  if [[ `jq '.items | length' ${TMPDIR}/bootstrap-${namespace}.json` -eq 0 ]] || retry-with-backoff apply-bootstrap $namespace
+  then
+    kubectl annotate namespace $namespace push-to-k8s/bootstrap=complete --overwrite > /dev/null
+  elif [[ $? -eq $POLICY_DENIED ]]
+  then
+    kubectl annotate namespace $namespace push-to-k8s/bootstrap=failed --overwrite > /dev/null
+  else
+    log-error "Bootstrap bundle failed for namespace: $namespace"
+    set-namespace-error $namespace "bootstrap bundle failed"
+    kubectl annotate namespace $namespace push-to-k8s/bootstrap=failed --overwrite > /dev/null
+    BOOTSTRAP_PENDING=`echo -e "${BOOTSTRAP_PENDING}\n${namespace}" | grep -v '^$'`
+  fi
+  set-status bootstrap-failed "$BOOTSTRAP_PENDING"
+}
+
+## Every sync trigger ends up here: the periodic sync, the canary rollout and
+## newly created namespaces. New namespaces are pushed regardless of the write
+## window, retried and bootstrapped; namespaces that are selected again after a
+## label change use the periodic trigger.
+reconcile-namespace() {
+  local namespace=$1
+  local trigger=$2
+  local result=0
+  if [[ $trigger == "new" ]]
+  then
+    retry-with-backoff push-to-namespace $namespace || { result=$?; queue-retry $namespace $result; }
+    bootstrap-namespace $namespace
+    count-namespace $namespace $result
+    return $result
+  elif in-write-window
+  then
+    push-to-namespace $namespace || result=$?
+    finish-namespace $namespace $result
+    return $result
+  else
+    log-debug "Outside write window, skipping namespace: $namespace"
+    SYNC_NAMESPACES[$namespace]=skipped
+  fi
+}
+
+finish-namespace() {
+  if [[ $2 -eq 0 ]]
+  then
+    unset "RETRY_QUEUE[$1]"
+  else
+    queue-retry $1 $2
+  fi
+  count-namespace $1 $2
+}
+
+## With SYNC_CONCURRENCY above 1 the periodic sync pushes to that many
+## namespaces at once, each in a subshell that leaves its exit code in
+## ${TMPDIR}/jobs/<namespace>. The retry queue and the sync result are kept
+## in this shell and updated as the jobs are reaped. Jobs ignore TERM, a
+## shutdown waits for them to finish their push.
+declare -A SYNC_JOBS
+
+start-sync-job() {
+  local namespace=$1
+  while (( ${#SYNC_JOBS[@]} >= SYNC_CONCURRENCY ))
+  do
+    wait -n "${!SYNC_JOBS[@]}"
+    reap-sync-jobs
+  done
+  mkdir -p ${TMPDIR}/jobs
+  (
+    trap '' TERM INT
+    push-to-namespace $namespace
+    echo $? > ${TMPDIR}/jobs/${namespace}
+  ) &
+  SYNC_JOBS[$!]=$namespace
+}
+
+reap-sync-jobs() {
+  for pid in "${!SYNC_JOBS[@]}"
+  do
+    local namespace=${SYNC_JOBS[$pid]}
+    if [[ ! $1 == "all" ]] && [[ ! -f ${TMPDIR}/jobs/${namespace} ]]
+    then
+      continue
+    fi
+    wait $pid
+    unset "SYNC_JOBS[$pid]"
+    finish-namespace $namespace `cat ${TMPDIR}/jobs/${namespace} 2> /dev/null || echo 1`
+    rm -f ${TMPDIR}/jobs/${namespace}
+  done
+}
+
+## Every full sync sums up what happened to the objects it applied (created,
+## updated, unchanged, applied server-side where kubectl doesn't tell these
+## apart, or skipped on a conflict) and to the namespaces it
+## pushed to, including new and retried ones, so a sync that failed everywhere
+## doesn't pass for a clean one. The summary is logged, kept under
+## last-sync.json and exported as metrics.
+declare -A SYNC_NAMESPACES
+
+count-result() {
+  add-to-counter sync-$1 ${2:-1} > /dev/null
+}
+
+count-applied() {
+  count-result created `echo "$1" | grep -c ' created$'`
+  count-result updated `echo "$1" | grep -c ' configured$'`
+  count-result unchanged `echo "$1" | grep -c ' unchanged$'`
+  count-result applied `echo "$1" | grep -c ' serverside-applied$'`
+}
+
+count-namespace() {
+  if [[ $2 -eq 0 ]]
+  then
+    SYNC_NAMESPACES[$1]=synced
+  else
+    SYNC_NAMESPACES[$1]=failed
+  fi
+}
+
+record-sync-result() {
+  local namespaces=`for namespace in "${!SYNC_NAMESPACES[@]}"; do echo "$namespace ${SYNC_NAMESPACES[$namespace]}"; done | sort`
+  local failed=`echo "$namespaces" | awk '$2 == "failed" {print $1}'`
+  local synced=`echo "$namespaces" | grep -c ' synced$'`
+  local error=""
+  local -A objects
+  for result in created updated unchanged applied skipped
+  do
+    objects[$result]=`get-counter sync-${result}`
+  done
+  log-info "Sync finished: ${objects[created]} objects created, ${objects[updated]} updated, ${objects[unchanged]} unchanged, ${objects[applied]} applied, ${objects[skipped]} skipped; ${synced} namespaces synced, `echo "$namespaces" | grep -c ' skipped$'` skipped, `echo -n "$failed" | grep -c .` failed"
+  if [[ -n $failed ]]
+  then
+    error=`get-status errors.json | jq -n -r --arg failed "$failed" '(input? // {}) as $errors | [$failed | split("\n")[] | "\(.): \($errors[.].error // "no error recorded")"] | join("; ")'`
+    if [[ $synced -eq 0 ]]
+    then
+      log-error "Sync failed in every namespace: ${error}"
+    else
+      log-error "Sync failed in `echo "$failed" | wc -l` namespaces: ${error}"
+    fi
+  fi
+  set-status last-sync.json "$(echo "$namespaces" | jq -R -s --arg time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --arg error "$error" \
+    --argjson created ${objects[created]} --argjson updated ${objects[updated]} --argjson unchanged ${objects[unchanged]} --argjson applied ${objects[applied]} --argjson skipped ${objects[skipped]} '
+    [split("\n")[] | select(. != "") | split(" ") | {name: .[0], result: .[1]}] as $namespaces
+    | {time: $time,
+      objects: {created: $created, updated: $updated, unchanged: $unchanged, applied: $applied, skipped: $skipped},
+      namespaces: (["synced", "skipped", "failed"] | map(. as $result | {key: ., value: ($namespaces | map(select(.result == $result)) | length)}) | from_entries),
+      failed: [$namespaces[] | select(.result == "failed") | .name],
+      error: (if $error == "" then null else $error end)}')"
+  for result in created updated unchanged applied skipped
+  do
+    echo "push_to_k8s_last_sync_objects{result=\"${result}\"} ${objects[$result]}"
+  done | set-metric push_to_k8s_last_sync_objects gauge "Objects applied by the last full sync, by result; skipped counts conflicts left alone."
+  for result in synced skipped failed
+  do
+    echo "push_to_k8s_last_sync_namespaces{result=\"${result}\"} `echo "$namespaces" | grep -c " ${result}$"`"
+  done | set-metric push_to_k8s_last_sync_namespaces gauge "Namespaces pushed to by the last full sync, by result; skipped counts those outside the write window."
+}
+
+## Namespaces whose push failed are retried between full syncs, after
+## FAILED_NAMESPACE_BACKOFF seconds doubling with every attempt (capped at
+## SLEEP), up to FAILED_NAMESPACE_RETRIES times. The queue maps a namespace to
+## "<attempt> <due>". Policy denials aren't retried.
+declare -A RETRY_QUEUE
+declare -A RETRY_OUTCOMES
+
+queue-retry() {
+  local namespace=$1
+  local attempt=$(( ${RETRY_QUEUE[$namespace]%% *} + 1 ))
+  if [[ $2 -eq $POLICY_DENIED ]]
+  then
+    unset "RETRY_QUEUE[$namespace]"
+  elif (( attempt > FAILED_NAMESPACE_RETRIES ))
+  then
+    log-warn "Giving up on namespace ${namespace} until the next full sync"
+    unset "RETRY_QUEUE[$namespace]"
+    RETRY_OUTCOMES[exhausted]=$(( ${RETRY_OUTCOMES[exhausted]:-0} + 1 ))
+  else
+    local delay=$(( FAILED_NAMESPACE_BACKOFF << (attempt - 1) ))
+    delay=$(( delay > SLEEP ? SLEEP : delay ))
+    log-info "Retrying namespace ${namespace} in ${delay} seconds"
+    RETRY_QUEUE[$namespace]="${attempt} $(( SECONDS + delay ))"
+  fi
+  record-retries
+}
+
+process-retries() {
+  if [[ ${#RETRY_QUEUE[@]} -eq 0 ]]
+  then
+    return
+  fi
+  for namespace in "${!RETRY_QUEUE[@]}"
+  do
+    if (( ${RETRY_QUEUE[$namespace]#* } > SECONDS ))
+    then
+      continue
+    elif ! echo "$KNOWN_NAMESPACES" | grep -qxF $namespace
+    then
+      unset "RETRY_QUEUE[$namespace]"
+    elif reconcile-namespace $namespace retry
+    then
+      RETRY_OUTCOMES[synced]=$(( ${RETRY_OUTCOMES[synced]:-0} + 1 ))
+    else
+      RETRY_OUTCOMES[failed]=$(( ${RETRY_OUTCOMES[failed]:-0} + 1 ))
+    fi
+  done
+  record-retries
+}
+
+record-retries() {
+  for outcome in synced failed exhausted
+  do
+    echo "push_to_k8s_namespace_retries_total{outcome=\"${outcome}\"} ${RETRY_OUTCOMES[$outcome]:-0}"
+  done | set-metric push_to_k8s_namespace_retries_total counter "Retries of namespaces whose push failed, by outcome; exhausted counts namespaces given up on until the next full sync."
+  echo "push_to_k8s_retry_queue_length ${#RETRY_QUEUE[@]}" | set-metric push_to_k8s_retry_queue_length gauge "Namespaces waiting to be retried."
+}
+
+## Histograms are kept as cumulative bucket counts; the bucket bounds are
+## passed with every observation.
+declare -A HISTOGRAMS
+
+observe-histogram() {
+  local name=$1
+  local help=$2
+  local value=$3
+  shift 3
+  for le in "$@" +Inf
+  do
+    if [[ $le == "+Inf" ]] || (( value <= le ))
+    then
+      HISTOGRAMS[$name,$le]=$(( ${HISTOGRAMS[$name,$le]:-0} + 1 ))
+    fi
+  done
+  HISTOGRAMS[$name,sum]=$(( ${HISTOGRAMS[$name,sum]:-0} + value ))
+  HISTOGRAMS[$name,count]=$(( ${HISTOGRAMS[$name,count]:-0} + 1 ))
+  {
+    for le in "$@" +Inf
+    do
+      echo "${name}_bucket{le=\"${le}\"} ${HISTOGRAMS[$name,$le]:-0}"
+    done
+    echo "${name}_sum ${HISTOGRAMS[$name,sum]}"
+    echo "${name}_count ${HISTOGRAMS[$name,count]}"
+  } | set-metric $name histogram "$help"
+}
+
+## Counts what the new-namespace check saw, to verify it picks up the changes
+## we expect: namespaces created (added), changed so they are synced or
+## skipped now (updated), or deleted, by what came of them.
+declare -A NAMESPACE_EVENTS
+
+count-namespace-event() {
+  local event=updated
+  if ! echo "$2" | grep -qxF $1
+  then
+    event=added
+  fi
+  NAMESPACE_EVENTS["${event},$3"]=$(( ${NAMESPACE_EVENTS["${event},$3"]:-0} + 1 ))
+}
+
+record-namespace-events() {
+  for key in "${!NAMESPACE_EVENTS[@]}"
+  do
+    echo "push_to_k8s_namespace_events_total{event=\"${key%,*}\",outcome=\"${key#*,}\"} ${NAMESPACE_EVENTS[$key]}"
+  done | sort | set-metric push_to_k8s_namespace_events_total counter "Namespace changes seen by the new-namespace check, by the sync they triggered."
+}
+
+## New namespaces jump ahead of the periodic backfill: anything that showed up
+## since the last listing, including namespaces a label change made eligible,
+## is pushed straight away instead of waiting for the next full sync. Only
+## namespaces created since are bootstrapped and pushed outside the write
+## window; re-selected ones are synced like by the periodic sync.
+sync-new-namespaces() {
+  if [[ $OUTPUT_MODE == "fleet" ]]
+  then
+    record-health
+    return
+  elif (( SECONDS - LAST_NAMESPACE_POLL < NEW_NAMESPACE_POLL ))
+  then
+    return
+  fi
+  LAST_NAMESPACE_POLL=$SECONDS
+  record-health
+  check-namespace-lists
+  local current
+  if ! current=`list-namespaces`
+  then
+    log-warn "Listing namespaces failed, skipping this check"
+    return
+  fi
+  local previous=$ALL_NAMESPACES
+  ALL_NAMESPACES=`awk '{print $2}' ${STATEDIR}/namespace-rules`
+  record-skipped-namespaces
+  local new_namespaces=`echo "$current" | grep -vxF -f <(echo "$KNOWN_NAMESPACES")`
+  if [[ -n $new_namespaces ]]
+  then
+    observe-histogram push_to_k8s_new_namespace_batch_size "New namespaces found per check." `echo "$new_namespaces" | wc -l` 1 2 5 10 50
+  fi
+  for new_namespace in $new_namespaces
+  do
+    local trigger=new
+    if echo "$previous" | grep -qxF $new_namespace
+    then
+      log-info "Namespace ${new_namespace} is selected now"
+      trigger=periodic
+    else
+      log-info "New namespace detected"
+    fi
+    if reconcile-namespace $new_namespace $trigger
+    then
+      if [[ ${SYNC_NAMESPACES[$new_namespace]} == "skipped" ]]
+      then
+        count-namespace-event $new_namespace "$previous" skipped
+      else
+        count-namespace-event $new_namespace "$previous" synced
+      fi
+    else
+      count-namespace-event $new_namespace "$previous" failed
+    fi
+    local created=`awk -v namespace=$new_namespace '$2 == namespace {print $3}' ${STATEDIR}/namespace-rules`
+    if ! echo "$previous" | grep -qxF $new_namespace && [[ ! $created == "null" ]]
+    then
+      observe-histogram push_to_k8s_new_namespace_latency_seconds "Seconds from the creation of a namespace until it was pushed to." \
+        $(( `date -u +%s` - `date -u -d $created +%s` )) 1 5 10 30 60 300
+    fi
+  done
+  for skipped in `awk '$1 != "selected" {print $2}' ${STATEDIR}/namespace-rules | grep -vxF -f <(echo "$KNOWN_NAMESPACES")`
+  do
+    if ! echo "$previous" | grep -qxF $skipped
+    then
+      count-namespace-event $skipped "$previous" skipped
+    fi
+  done
+  for skipped in `echo "$KNOWN_NAMESPACES" | grep -vxF -f <(echo "$current")`
+  do
+    if echo "$ALL_NAMESPACES" | grep -qxF $skipped
+    then
+      count-namespace-event $skipped "$previous" skipped
+      if [[ ! $OBSERVE_ONLY == "true" ]]
+      then
+        CLEANUP_PENDING=`echo "$CLEANUP_PENDING"; echo $skipped`
+      fi
+    else
+      NAMESPACE_EVENTS["deleted,none"]=$(( ${NAMESPACE_EVENTS["deleted,none"]:-0} + 1 ))
+    fi
+  done
+  for deleted in `echo "$previous" | grep -vxF -f <(echo "$ALL_NAMESPACES") | grep -vxF -f <(echo "$KNOWN_NAMESPACES")`
+  do
+    NAMESPACE_EVENTS["deleted,none"]=$(( ${NAMESPACE_EVENTS["deleted,none"]:-0} + 1 ))
+  done
+  KNOWN_NAMESPACES=$current
+  clean-up-namespaces
+  record-namespace-events
+  for pending in $BOOTSTRAP_PENDING
+  do
+    bootstrap-namespace $pending
+  done
+}
+
+## With SPREAD_WRITES each namespace gets a fixed slot in the sync interval
+## (derived from its name, plus a little jitter) so a full sync is spread out
+## instead of hitting the API server in one burst. Namespaces a shutdown left
+## pending go first.
+schedule-namespaces() {
+  local pending=`get-status pending-namespaces`
+  for namespace in $namespaces
+  do
+    if echo "$pending" | grep -qxF $namespace
+    then
+      echo "0 $namespace"
+    fi
+  done
   for namespace in $namespaces
   do
-    echo "Namespace: $namespace"
-    if [[ $namespace == $SYNCNAMESPACE ]]
+    if echo "$pending" | grep -qxF $namespace
+    then
+      continue
+    elif [[ $SPREAD_WRITES == "true" ]]
+    then
+      offset=$(( $(echo -n $namespace | cksum | awk '{print $1}') % SLEEP ))
+      offset=$(( offset + RANDOM % (2 * SPREAD_JITTER + 1) - SPREAD_JITTER ))
+      offset=$(( offset < 0 ? 0 : offset >= SLEEP ? SLEEP - 1 : offset ))
+      echo "$offset $namespace"
+    else
+      echo "0 $namespace"
+    fi
+  done | sort -n -s -k1,1
+}
+
+## WRITE_WINDOW (UTC, may wrap midnight) and WRITE_WINDOW_DAYS limit when the
+## periodic sync, PushSecrets, Fleet bundles and collected secrets are allowed
+## to change anything. Equal bounds open the whole day, e.g. 00:00-00:00 with
+## WRITE_WINDOW_DAYS alone. New namespaces are always bootstrapped.
+in-write-window() {
+  if [[ -z $WRITE_WINDOW ]]
+  then
+    return 0
+  fi
+  if [[ -n $WRITE_WINDOW_DAYS ]] && [[ ! ",${WRITE_WINDOW_DAYS}," == *",$(date -u +%a),"* ]]
+  then
+    return 1
+  fi
+  local now=$(( 10#$(date -u +%H%M) ))
+  local start=$(( 10#$(echo ${WRITE_WINDOW%-*} | tr -d ':') ))
+  local end=$(( 10#$(echo ${WRITE_WINDOW#*-} | tr -d ':') ))
+  if (( start == end ))
+  then
+    return 0
+  elif (( start < end ))
+  then
+    (( now >= start && now < end ))
+  else
+    (( now >= start || now < end ))
+  fi
+}
+
+## Sleeps in the background so a SIGTERM is handled right away. With
+## "sources" as the second argument, the wait also ends once the sources
+## changed.
+wait-until() {
+  local deadline=$1
+  while (( SECONDS < deadline )) && [[ -z $SHUTDOWN_DEADLINE ]]
+  do
+    sleep $(( NEW_NAMESPACE_POLL < deadline - SECONDS ? NEW_NAMESPACE_POLL : deadline - SECONDS )) &
+    wait $!
+    sync-new-namespaces
+    process-retries
+    if [[ $2 == "sources" ]] && sources-changed
+    then
+      return
+    fi
+  done
+}
+
+## The resourceVersion of every labeled object in the source namespaces.
+source-fingerprint() {
+  local objects
+  if [[ $SOURCE_DISCOVERY == "cluster" ]]
+  then
+    objects=`kubectl get secret,configmap,networkpolicy,role,rolebinding -A -l push-to-k8s -o json` || return 1
+  else
+    for namespace in ${SOURCE_NAMESPACES//,/ }
+    do
+      objects+=`kubectl -n $namespace get secret,configmap,networkpolicy,role,rolebinding -l push-to-k8s -o json` || return 1
+    done
+  fi
+  echo "$objects" | jq -r '.items[] | "\(.kind)/\(.metadata.namespace)/\(.metadata.name) \(.metadata.resourceVersion)"' | sort | cksum
+}
+
+## With WATCH_SOURCES the sources are checked every SOURCE_POLL seconds
+## between full syncs, and a change starts the next one early: once the
+## sources were left alone for SOURCE_SYNC_DEBOUNCE seconds, so a batch of
+## edits syncs once, and no sooner than SOURCE_SYNC_MIN_INTERVAL seconds after
+## the last full sync started. Changes folded into a pending one and the
+## seconds a settled change waited for the minimum interval are counted, to
+## tell whether the limit holds syncs back during a rotation.
+sources-changed() {
+  if [[ ! $WATCH_SOURCES == "true" ]] || (( SECONDS - LAST_SOURCE_POLL < SOURCE_POLL ))
+  then
+    return 1
+  fi
+  LAST_SOURCE_POLL=$SECONDS
+  local fingerprint
+  if ! fingerprint=`source-fingerprint` || [[ $fingerprint == $SOURCE_FINGERPRINT ]]
+  then
+    return 1
+  fi
+  if [[ ! $fingerprint == $CHANGED_FINGERPRINT ]]
+  then
+    log-debug "Sources changed"
+    if [[ -n $CHANGED_FINGERPRINT ]] && [[ ! $CHANGED_FINGERPRINT == $SOURCE_FINGERPRINT ]]
+    then
+      echo "push_to_k8s_source_changes_coalesced_total `add-to-counter source-changes-coalesced 1`" \
+        | set-metric push_to_k8s_source_changes_coalesced_total counter "Source changes folded into a change already waiting for the debounce."
+    fi
+    CHANGED_FINGERPRINT=$fingerprint
+    SOURCES_CHANGED_AT=$SECONDS
+  fi
+  if (( SECONDS - SOURCES_CHANGED_AT < SOURCE_SYNC_DEBOUNCE || SECONDS - SYNC_STARTED_AT < SOURCE_SYNC_MIN_INTERVAL ))
+  then
+    return 1
+  fi
+  local limited=$(( SYNC_STARTED_AT + SOURCE_SYNC_MIN_INTERVAL - SOURCES_CHANGED_AT - SOURCE_SYNC_DEBOUNCE ))
+  if (( limited > 0 ))
+  then
+    echo "push_to_k8s_source_sync_rate_limited_seconds_total `add-to-counter source-sync-rate-limited $limited`" \
+      | set-metric push_to_k8s_source_sync_rate_limited_seconds_total counter "Seconds settled source changes waited for SOURCE_SYNC_MIN_INTERVAL."
+  fi
+  log-info "Sources changed, starting the next sync"
+  return 0
+}
+
+## On SIGTERM the current cycle is finished without waiting for slots or the
+## canary soak, and namespaces created meanwhile are still pushed, until
+## SHUTDOWN_TIMEOUT runs out; then the loop exits.
+request-shutdown() {
+  if [[ -z $SHUTDOWN_DEADLINE ]]
+  then
+    log-info "Shutting down, finishing pending pushes within ${SHUTDOWN_TIMEOUT} seconds"
+    SHUTDOWN_DEADLINE=$(( SECONDS + SHUTDOWN_TIMEOUT ))
+  fi
+}
+
+shutdown-expired() {
+  [[ -n $SHUTDOWN_DEADLINE ]] && (( SECONDS >= SHUTDOWN_DEADLINE ))
+}
+
+## The inverse of the push: with COLLECT_SECRETS, secrets labeled
+## push-to-k8s=collect in any namespace are copied into the source namespace,
+## e.g. to gather per-tenant generated credentials in one place. With
+## COLLECT_PREFIX (the default) the copies are named <namespace>-<name>,
+## otherwise a name collected from more than one namespace is skipped. A secret
+## in the source namespace is only overwritten by the collection it came from,
+## so a tenant can't replace a source by collecting a secret of the same name.
+collect-secrets() {
+  log-info "Collecting secrets..."
+  kubectl get secret -A -l push-to-k8s=collect -o json | jq --arg target $SYNCNAMESPACE --arg prefix $COLLECT_PREFIX '
+    del(.metadata) | .items |= [.[] | select(.metadata.namespace != $target)
+      | .metadata.annotations["push-to-k8s/collected-from"] = "\(.metadata.namespace)/\(.metadata.name)"
+      | if $prefix == "true" then .metadata.name = "\(.metadata.namespace)-\(.metadata.name)" else . end
+      | del(.metadata.namespace, .metadata.uid, .metadata.resourceVersion, .metadata.creationTimestamp, .metadata.generation, .metadata.managedFields, .metadata.ownerReferences, .metadata.labels["push-to-k8s"], .metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"])]' > ${TMPDIR}/collected.json
+  for conflict in `jq -r '.items | group_by(.metadata.name)[] | select(length > 1) | "\(.[0].metadata.name):\(map(.metadata.annotations["push-to-k8s/collected-from"] | split("/")[0]) | join(","))"' ${TMPDIR}/collected.json`
+  do
+    log-warn "Collect conflict, secret ${conflict%%:*} exists in namespaces ${conflict#*:}, skipping it"
+    emit-event CollectConflict "Secret ${conflict%%:*} exists in namespaces ${conflict#*:}"
+  done
+  jq '.items |= (group_by(.metadata.name) | map(select(length == 1)[]))' ${TMPDIR}/collected.json > ${TMPDIR}/collected.json.tmp && mv ${TMPDIR}/collected.json.tmp ${TMPDIR}/collected.json
+  if ! kubectl -n $SYNCNAMESPACE get secret -o json > ${TMPDIR}/collect-targets.json
+  then
+    log-error "Listing secrets in ${SYNCNAMESPACE} failed, skipping the collection"
+    return
+  fi
+  for conflict in `jq -r --slurpfile targets ${TMPDIR}/collect-targets.json '
+    ($targets[0].items | map({key: .metadata.name, value: (.metadata.annotations["push-to-k8s/collected-from"] // "")}) | from_entries) as $existing
+    | .items[] | select($existing[.metadata.name] != null and $existing[.metadata.name] != .metadata.annotations["push-to-k8s/collected-from"])
+    | "\(.metadata.name):\(.metadata.annotations["push-to-k8s/collected-from"])"' ${TMPDIR}/collected.json`
+  do
+    log-warn "Collect conflict, secret ${conflict%%:*} in ${SYNCNAMESPACE} wasn't collected from ${conflict#*:}, skipping it"
+    emit-event CollectConflict "Secret ${conflict%%:*} in ${SYNCNAMESPACE} wasn't collected from ${conflict#*:}"
+  done
+  jq --slurpfile targets ${TMPDIR}/collect-targets.json '
+    ($targets[0].items | map({key: .metadata.name, value: (.metadata.annotations["push-to-k8s/collected-from"] // "")}) | from_entries) as $existing
+    | .items |= map(select($existing[.metadata.name] == null or $existing[.metadata.name] == .metadata.annotations["push-to-k8s/collected-from"]))' ${TMPDIR}/collected.json > ${TMPDIR}/collected.json.tmp && mv ${TMPDIR}/collected.json.tmp ${TMPDIR}/collected.json
+  if [[ `jq '.items | length' ${TMPDIR}/collected.json` -gt 0 ]] && [[ ! $OBSERVE_ONLY == "true" ]] && in-write-window
+  then
+    kubectl -n $SYNCNAMESPACE apply -f ${TMPDIR}/collected.json || log-error "Collecting secrets into ${SYNCNAMESPACE} failed"
+  fi
+}
+
+## With the PushSecrets gate, PushSecret objects (crds.yaml) declare single
+## distributions next to the environment-wide one: a secret from the
+## PushSecret's namespace goes to the namespaces its selector picks, optionally
+## renamed and with extra labels and annotations. Copies carry
+## push-to-k8s/push-secret=<namespace>/<name>, and an existing secret without
+## that annotation is never overwritten. The state of every target namespace
+## is written to the PushSecret's status. A PushSecret only reaches namespaces
+## the targeting rules select that also accept it by listing its namespace
+## (or *) in their push-to-k8s/push-secrets-from annotation, so tenants can be
+## given PushSecrets without writing into each other's namespaces.
+## ClusterPushSecrets are the cluster-scoped variant for platform admins: they
+## name the source namespace in spec.sourceNamespace, reach every namespace
+## their selector picks, and their copies carry
+## push-to-k8s/push-secret=ClusterPushSecret/<name>. Copies no PushSecret
+## wants anymore are removed by DELETE_POLICY.
+label-selector() {
+  jq -r '[(.matchLabels // {} | to_entries[] | "\(.key)=\(.value)"),
+    ((.matchExpressions // [])[] | if .operator == "In" then "\(.key) in (\(.values | join(",")))"
+      elif .operator == "NotIn" then "\(.key) notin (\(.values | join(",")))"
+      elif .operator == "Exists" then .key
+      else "!\(.key)" end)] | join(",")'
+}
+
+sync-push-secrets() {
+  local pushsecrets listed=true
+  : > ${TMPDIR}/pushsecret-copies
+  for resource in pushsecrets clusterpushsecrets
+  do
+    if ! pushsecrets=`kubectl get ${resource}.push-to-k8s.support.tools -A -o json`
+    then
+      log-error "Listing ${resource} failed"
+      listed=false
+      continue
+    fi
+    while read -r pushsecret
+    do
+      sync-push-secret "$pushsecret"
+    done < <(echo "$pushsecrets" | jq -c '.items[]')
+  done
+  if [[ $listed == "true" ]]
+  then
+    collect-push-secret-copies
+  fi
+}
+
+## Removes copies whose PushSecret is gone or no longer targets their
+## namespace, as recorded in ${TMPDIR}/pushsecret-copies by the sync.
+collect-push-secret-copies() {
+  local copies
+  if ! copies=`kubectl get secret -A -o json`
+  then
+    log-warn "Listing PushSecret copies failed, skipping their cleanup"
+    return
+  fi
+  local removals=`echo "$copies" | jq -r --rawfile wanted ${TMPDIR}/pushsecret-copies '
+    ($wanted | split("\n")) as $wanted
+    | .items[] | .metadata.annotations as $annotations
+    | select($annotations["push-to-k8s/push-secret"] and $annotations["push-to-k8s/retained-at"] == null)
+    | select("\($annotations["push-to-k8s/push-secret"]) \(.metadata.namespace) \(.metadata.name)" | IN($wanted[]) | not)
+    | select($annotations["push-to-k8s/push-secret"] | IN($wanted[] | split(" ")[0] | select(endswith("!"))[:-1]) | not)
+    | "\(.metadata.namespace) secret/\(.metadata.name)"'`
+  if [[ -z $removals ]] || removal-blocked "$removals" "PushSecret cleanup"
+  then
+    return
+  fi
+  while read -r namespace object
+  do
+    remove-copy $namespace $object "no PushSecret targets it anymore"
+  done <<< "$removals"
+}
+
+sync-push-secret() {
+  local kind=`echo "$1" | jq -r .kind`
+  local name=`echo "$1" | jq -r .metadata.name`
+  local selector=`echo "$1" | jq '.spec.namespaceSelector // {}' | label-selector`
+  local namespace owner scope
+  if [[ $kind == "ClusterPushSecret" ]]
+  then
+    namespace=`echo "$1" | jq -r .spec.sourceNamespace`
+    owner="ClusterPushSecret/${name}"
+  else
+    namespace=`echo "$1" | jq -r .metadata.namespace`
+    owner="${namespace}/${name}"
+    scope="-n ${namespace}"
+  fi
+  local results=${TMPDIR}/pushsecret-results
+  : > $results
+  log-info "${kind}: ${owner}"
+  local source
+  if ! source=`kubectl -n $namespace get secret $(echo "$1" | jq -r .spec.secretName) -o json 2>&1`
+  then
+    log-warn "${kind} ${owner}: ${source}"
+    emit-event PushSecretFailed "${kind} ${owner}: source secret not found"
+    if [[ ! $source == *NotFound* ]]
+    then
+      echo "${owner}!" >> ${TMPDIR}/pushsecret-copies
+    fi
+    return
+  fi
+  local manifest=${TMPDIR}/pushsecret.json
+  echo "$source" | jq --argjson pushsecret "$1" --arg owner $owner '{
+    apiVersion: "v1", kind: "Secret", type, data, immutable,
+    metadata: {
+      name: ($pushsecret.spec.targetName // $pushsecret.spec.secretName),
+      labels: ($pushsecret.spec.labels // {}),
+      annotations: (($pushsecret.spec.annotations // {}) + {"push-to-k8s/push-secret": $owner, "push-to-k8s/source-namespace": .metadata.namespace})}}
+    | del(.. | select(. == null))' > $manifest
+  local hash=`jq -c . $manifest | content-hashes`
+  jq --arg hash $hash '.metadata.annotations["push-to-k8s/source-hash"] = $hash' $manifest > ${manifest}.tmp && mv ${manifest}.tmp $manifest
+  local target=`jq -r .metadata.name $manifest`
+  local targets
+  if ! targets=`kubectl get namespace ${selector:+-l "$selector"} -o json`
+  then
+    log-warn "${kind} ${owner}: listing namespaces failed"
+    echo "${owner}!" >> ${TMPDIR}/pushsecret-copies
+    return
+  fi
+  for target_namespace in `echo "$targets" | jq -r --arg namespace $namespace --arg kind $kind --arg known "$KNOWN_NAMESPACES" '
+    .items[] | select(.metadata.name != $namespace and .status.phase != "Terminating")
+    | select($kind == "ClusterPushSecret" or ((.metadata.name | IN($known | split("\n")[]))
+      and ((.metadata.annotations["push-to-k8s/push-secrets-from"] // "") | split(",") | map(ltrimstr(" ") | rtrimstr(" ")) | any(. == "*" or . == $namespace))))
+    | .metadata.name'`
+  do
+    local existing output
+    echo "${owner} ${target_namespace} ${target}" >> ${TMPDIR}/pushsecret-copies
+    existing=`kubectl -n $target_namespace get secret $target -o json 2> /dev/null | jq -r '.metadata.annotations["push-to-k8s/push-secret"] // "unmanaged"'`
+    if [[ -n $existing ]] && [[ ! $existing == $owner ]]
+    then
+      log-warn "${kind} ${owner}: secret/${target} in namespace ${target_namespace} isn't managed by it, skipping"
+      echo "$target_namespace conflict secret/${target} exists and isn't managed by this ${kind}" >> $results
+    elif output=`kubectl -n $target_namespace apply "${APPLY_ARGS[@]}" -f $manifest 2>&1`
+    then
+      log-info "$output"
+      echo "$target_namespace synced" >> $results
+    else
+      log-warn "$output"
+      echo "$target_namespace failed $(echo "$output" | grep -i 'error' | tail -n 1)" >> $results
+    fi
+  done
+  local status=`jq -R -s --argjson generation $(echo "$1" | jq '.metadata.generation // 0') --arg time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" '
+    [split("\n")[] | select(length > 0) | capture("^(?<namespace>[^ ]+) (?<state>[^ ]+) ?(?<error>.*)$")] as $results
+    | {status: {
+        observedGeneration: $generation,
+        lastSyncTime: $time,
+        syncedNamespaces: ($results | map(select(.state == "synced")) | length),
+        failedNamespaces: ($results | map(select(.state != "synced")) | length),
+        namespaces: ($results | map({key: .namespace, value: ({state, time: $time} + (if .error == "" then {} else {error} end))}) | from_entries)}}
+    | [{op: "add", path: "/status", value: .status}]' $results`
+  kubectl $scope patch ${kind,,}s.push-to-k8s.support.tools $name --subresource=status --type=json -p "$status" > /dev/null \
+    || log-warn "Updating the status of ${kind} ${owner} failed"
+}
+
+## The periodic sync of every selected namespace.
+sync-namespaces() {
+  if ! get-namespaces
+  then
+    BLOCKED="listing namespaces failed"
+    log-error "Listing namespaces failed, skipping this sync"
+    return
+  fi
+  clean-up-namespaces
+  if feature-enabled ReferenceAwareSync
+  then
+    index-secret-references
+  fi
+  check-mass-change
+  rm -f ${STATEDIR}/counters/sync-*
+  SYNC_NAMESPACES=()
+  canary-rollout
+  cycle_start=$SECONDS
+  mapfile -t schedule < <(schedule-namespaces)
+  for index in "${!schedule[@]}"
+  do
+    entry=${schedule[$index]}
+    wait-until $(( cycle_start + ${entry%% *} ))
+    if shutdown-expired
+    then
+      log-warn "Shutdown timeout reached, leaving $(( ${#schedule[@]} - index )) namespaces for the next start"
+      set-status pending-namespaces "$(printf '%s\n' "${schedule[@]:$index}" | cut -d ' ' -f 2)"
+      break
+    fi
+    sync-new-namespaces
+    if ! echo "$KNOWN_NAMESPACES" | grep -qxF ${entry#* }
+    then
+      log-debug "Namespace ${entry#* } isn't selected anymore, skipping"
+    elif (( SYNC_CONCURRENCY > 1 )) && in-write-window
+    then
+      reap-sync-jobs
+      start-sync-job ${entry#* }
+    else
+      reconcile-namespace ${entry#* } periodic
+    fi
+  done
+  reap-sync-jobs all
+  if ! shutdown-expired
+  then
+    set-status pending-namespaces ""
+  fi
+  record-sync-result
+}
+
+## With OUTPUT_MODE=fleet nothing is pushed to local namespaces. The sources
+## are rendered into a Fleet Bundle instead, which delivers them as sources
+## (labeled push-to-k8s=source or source-<set>) to FLEET_TARGET_NAMESPACE on
+## the downstream clusters, for the push-to-k8s running there to distribute.
+push-fleet-bundle() {
+  if [[ $OBSERVE_ONLY == "true" ]] || [[ -z $(ls ${PUSHDIR}) ]] || ! in-write-window
+  then
+    return
+  fi
+  log-info "Rendering Fleet bundle ${FLEET_BUNDLE} in namespace ${FLEET_NAMESPACE}"
+  jq -s --arg name $FLEET_BUNDLE --arg namespace $FLEET_NAMESPACE --arg target $FLEET_TARGET_NAMESPACE --argjson targets "$FLEET_TARGETS" '{
+    apiVersion: "fleet.cattle.io/v1alpha1",
+    kind: "Bundle",
+    metadata: {name: $name, namespace: $namespace, labels: {"app.kubernetes.io/managed-by": "push-to-k8s"}},
+    spec: {
+      defaultNamespace: $target,
+      resources: [.[].items[] | .metadata.namespace = $target | .metadata.labels["push-to-k8s"] = "source\(.metadata.annotations["push-to-k8s/source-set"] // "" | if . == "" then "" else "-\(.)" end)"
+        | {name: "\(.kind | ascii_downcase)-\(.metadata.name).yaml", content: tojson}],
+      targets: $targets}}' ${PUSHDIR}/*.json > ${TMPDIR}/bundle.json
+  local output
+  if output=`kubectl -n $FLEET_NAMESPACE apply -f ${TMPDIR}/bundle.json 2>&1`
+  then
+    log-info "$output"
+  else
+    log-error "Failed to apply Fleet bundle: $output"
+    emit-event FleetBundleFailed "Failed to apply Fleet bundle ${FLEET_BUNDLE}"
+  fi
+}
+
+run-sync() {
+  STARTED_AT=`date -u +%s`
+  VERSION=`sha256sum $0 | cut -c1-12`
+  setup
+  trap cleanup-state-dir EXIT
+  setup-state-dir
+  restore-status
+  echo "push_to_k8s_restarts_total ${RESTARTS:-0}" | set-metric push_to_k8s_restarts_total counter "Times the sync loop was restarted after exiting."
+  preflight-rbac
+  trap request-shutdown TERM INT
+  while true
+  do
+    setup-tmp-dir
+    if [[ $COLLECT_SECRETS == "true" ]]
+    then
+      collect-secrets
+    fi
+    build-source-yaml
+    check-approval
+    publish-status
+    : > ${STATEDIR}/drift
+    if [[ $OUTPUT_MODE == "fleet" ]]
+    then
+      cycle_start=$SECONDS
+      push-fleet-bundle
+    else
+      sync-namespaces
+      if [[ ! $OBSERVE_ONLY == "true" ]]
+      then
+        collect-garbage
+      fi
+      if feature-enabled PushSecrets && [[ ! $OBSERVE_ONLY == "true" ]] && in-write-window
+      then
+        sync-push-secrets
+      fi
+    fi
+    if [[ $OBSERVE_ONLY == "true" ]] || [[ $REPORT_DRIFT == "true" ]]
+    then
+      check-orphans
+      log-info "Copies with drift: $(wc -l < ${STATEDIR}/drift)"
+      record-drift
+    fi
+    if [[ ! $OBSERVE_ONLY == "true" ]] && [[ -n $(ls ${PUSHDIR}) ]] && [[ -z $BLOCKED ]] && in-write-window
     then
-      echo "Skipping source namespace"
+      set-status rolled-out-revision `source-revision $PUSHDIR`
+    fi
+    record-copies
+    LAST_SYNC_AT=`date -u +%s`
+    publish-status
+    if [[ $SPREAD_WRITES == "true" ]]
+    then
+      wait-until $(( cycle_start + SLEEP )) sources
     else
-      echo "Pushing out YAML"
-      kubectl -n $namespace apply -f ${TMPDIR}/
+      wait-until $(( SECONDS + SLEEP )) sources
+    fi
+    if [[ -n $SHUTDOWN_DEADLINE ]]
+    then
+      if ! shutdown-expired
+      then
+        LAST_NAMESPACE_POLL=0
+        sync-new-namespaces
+      fi
+      publish-status
+      log-info "Shutdown complete"
+      exit 0
+    fi
+    cleanup-tmp-dir
+  done
+}
+
+## A sync loop that exits, the default one or a profile's, is restarted with a
+## doubling delay (capped at five minutes, reset once it ran for ten), so one
+## failing profile doesn't leave the pod running without it.
+supervise() {
+  local delay=1
+  local started
+  local result
+  local child
+  RESTARTS=0
+  trap 'STOPPING=true; kill -TERM $child' TERM INT
+  while true
+  do
+    started=$SECONDS
+    ( run-sync ) &
+    child=$!
+    wait $child
+    result=$?
+    if [[ -n $STOPPING ]]
+    then
+      wait $child
+      return
+    fi
+    if (( SECONDS - started > 600 ))
+    then
+      delay=1
+    fi
+    RESTARTS=$(( RESTARTS + 1 ))
+    log-error "Sync loop exited with status ${result}, restarting in ${delay} seconds"
+    sleep $delay
+    delay=$(( delay * 2 > 300 ? 300 : delay * 2 ))
+  done
+}
+
+## SYNC_PROFILES_DIR holds one file per profile (e.g. a mounted ConfigMap),
+## each a list of KEY=value settings. Every profile runs its own sync loop with
+## those settings on top of the workload's environment.
+run-profiles() {
+  local supervisors=()
+  trap 'kill -TERM ${supervisors[@]}' TERM INT
+  for profile in `ls ${SYNC_PROFILES_DIR}`
+  do
+    (
+      while IFS='=' read -r key value
+      do
+        if [[ -n $key ]] && [[ ! $key == \#* ]]
+        then
+          export "${key}=${value}"
+        fi
+      done < ${SYNC_PROFILES_DIR}/${profile}
+      PROFILE=$profile
+      exec > >(trap "" TERM; exec sed -u "s/^/[${profile}] /") 2>&1
+      supervise
+    ) &
+    supervisors+=($!)
+  done
+  wait
+  wait
+}
+
+## Prints the published state as a table, json or yaml and exits 0 when
+## everything is in sync, 1 when drift was reported, 2 when namespaces are
+## failing and 3 when the configuration or reading the status fails, so
+## pipelines can gate on it.
+print-status() {
+  local output=table
+  while [[ $# -gt 0 ]]
+  do
+    case $1 in
+      -o|--output)
+        output=$2
+        shift 2
+        ;;
+      --output=*)
+        output=${1#*=}
+        shift
+        ;;
+      *)
+        log-error "Unknown option: $1"
+        exit 3
+        ;;
+    esac
+  done
+  local status
+  status=`kubectl -n $SYNCNAMESPACE get configmap ${STATUS_CONFIGMAP} -o json` || exit 3
+  status=`echo "$status" | jq '.data // {} | {
+    revisions: with_entries(select(.key | endswith("-revision")) | .key |= rtrimstr("-revision")),
+    blocked: (.blocked // "" | if . == "" then null else . end),
+    drift: (.["drift.json"] // "[]" | fromjson),
+    errors: (.["errors.json"] // "{}" | fromjson),
+    skipped: (.["skipped-namespaces.json"] // "{}" | fromjson),
+    health: (.["health.json"] // "{}" | fromjson)}'`
+  case $output in
+    json)
+      echo "$status"
+      ;;
+    yaml)
+      echo "$status" | jq -r '
+        def yaml($indent): if type == "object" and length > 0 then to_entries[] | if (.value | type) == "object" and (.value | length) > 0 or (.value | type) == "array" and (.value | length) > 0 then "\($indent)\(.key):", (.value | yaml($indent + "  ")) else "\($indent)\(.key): \(.value | tojson)" end
+          elif type == "array" and length > 0 then .[] | if type == "object" and length > 0 then ([yaml($indent + "  ")] | to_entries[] | if .key == 0 then .value | sub("^\($indent)  "; "\($indent)- ") else .value end) else "\($indent)- \(tojson)" end
+          else "\($indent)\(tojson)" end;
+        yaml("")'
+      ;;
+    table)
+      echo "$status" | jq -r '.health | to_entries[] | "\(.key): \(.value)"'
+      echo "$status" | jq -r '.revisions | to_entries[] | "\(.key)-revision: \(.value)"'
+      echo "$status" | jq -r 'if .blocked then "blocked: \(.blocked)" else empty end'
+      echo "$status" | jq -r '.skipped | to_entries[] | "skipped by \(.key): \(.value | join(", "))"'
+      echo "$status" | jq -r '.drift | if length == 0 then empty else "Copies with drift: \(length)" end'
+      echo "$status" | jq -r '.errors | to_entries | if length == 0 then "No failing namespaces" else (["NAMESPACE", "TIME", "ERROR"], (.[] | [.key, .value.time, .value.error])) | @tsv end'
+      ;;
+    *)
+      log-error "Unknown output format: $output (json, yaml or table)"
+      exit 3
+      ;;
+  esac
+  if echo "$status" | jq -e '.errors | length > 0' > /dev/null
+  then
+    exit 2
+  elif echo "$status" | jq -e '.drift | length > 0' > /dev/null
+  then
+    exit 1
+  fi
+}
+
+## A matrix of every source against every namespace the controller pushed to,
+## from the published checksums: synced when the namespace got the current
+## content, outdated or missing otherwise, and failed for namespaces whose
+## last push failed. Only hashes are compared, no data is printed.
+distribution-report() {
+  local objects checksums status
+  objects=`for kind in secret configmap networkpolicy role rolebinding
+  do
+    get-sources $kind | clean-source | project-source-keys
+  done | jq -c '.items[]'` || return 1
+  checksums=`kubectl -n $SYNCNAMESPACE get configmap ${CHECKSUMS_CONFIGMAP} -o json` || return 1
+  status=`kubectl -n $SYNCNAMESPACE get configmap ${STATUS_CONFIGMAP} -o json` || return 1
+  paste -d ' ' <(echo "$objects" | jq -r '"\(.kind)/\(.metadata.name)"') <(echo "$objects" | content-hashes) | jq -R -s \
+    --argjson checksums "$checksums" --argjson status "$status" '
+    ($checksums.data // {} | map_values(fromjson)) as $pushed
+    | ($status.data["errors.json"] // "{}" | fromjson) as $errors
+    | ($status.data["synced-at.json"] // "{}" | fromjson) as $synced
+    | [split("\n")[] | select(length > 0) | split(" ") | . as [$source, $hash]
+      | ($pushed + $errors | keys[]) as $namespace
+      | {source: $source, namespace: $namespace,
+         state: (if $pushed[$namespace][$source] == $hash then "synced"
+           elif $errors[$namespace] then "failed"
+           elif $pushed[$namespace][$source] then "outdated"
+           else "missing" end),
+         synced: $synced[$namespace]}]'
+}
+
+print-report() {
+  local output=table
+  while [[ $# -gt 0 ]]
+  do
+    case $1 in
+      -o|--output)
+        output=$2
+        shift 2
+        ;;
+      --output=*)
+        output=${1#*=}
+        shift
+        ;;
+      *)
+        log-error "Unknown option: $1"
+        exit 1
+        ;;
+    esac
+  done
+  local report
+  report=`distribution-report` || exit 1
+  case $output in
+    json)
+      echo "$report"
+      ;;
+    csv)
+      echo "$report" | jq -r '(["source", "namespace", "state", "synced"], (.[] | [.source, .namespace, .state, .synced])) | @csv'
+      ;;
+    table)
+      echo "$report" | jq -r '(map(.source) | unique) as $sources
+        | (["NAMESPACE", "SYNCED"] + $sources),
+          (group_by(.namespace)[] | map({key: .source, value: .state}) as $states | [.[0].namespace, .[0].synced // "-"] + [$sources[] as $source | $states | from_entries | .[$source]])
+        | @tsv'
+      ;;
+    *)
+      log-error "Unknown output format: $output (table, json or csv)"
+      exit 1
+      ;;
+  esac
+}
+
+## For audits: every source secret with the time its content last changed and
+## its state in every namespace, the reported drift, and the sources that were
+## refused for a bad signature or invalid content. With SIGNING_KEY_FILE the
+## report is signed with the same HMAC as the sources, as a "signature" field
+## in json or a trailing "# hmac-sha256" line over everything before it in csv.
+print-compliance-report() {
+  local output=json
+  while [[ $# -gt 0 ]]
+  do
+    case $1 in
+      -o|--output)
+        output=$2
+        shift 2
+        ;;
+      --output=*)
+        output=${1#*=}
+        shift
+        ;;
+      *)
+        log-error "Unknown option: $1"
+        exit 1
+        ;;
+    esac
+  done
+  local copies status events
+  copies=`distribution-report` || exit 1
+  status=`kubectl -n $SYNCNAMESPACE get configmap ${STATUS_CONFIGMAP} -o json` || exit 1
+  events=`kubectl -n $SYNCNAMESPACE get events -o json` || exit 1
+  local report=`jq -n --argjson copies "$copies" --argjson status "$status" --argjson events "$events" --arg namespace $SYNCNAMESPACE '
+    ($status.data["secret-ages.json"] // "{}" | fromjson) as $ages
+    | {generated: (now | todate), sourceNamespace: $namespace,
+       secrets: [$copies[] | select(.source | startswith("Secret/"))] | group_by(.source) | map({
+         name: (.[0].source | ltrimstr("Secret/")),
+         lastChanged: $ages[.[0].source | ltrimstr("Secret/")].since,
+         namespaces: map({namespace, state, synced})}),
+       drift: [$status.data["drift.json"] // "[]" | fromjson | .[] | select(.kind == "Secret")],
+       tamperEvents: [$events.items[] | select(.reason | IN("SignatureRejected", "InvalidSource")) | {time: .lastTimestamp, reason, message}]}'`
+  case $output in
+    json)
+      if [[ -n $SIGNING_KEY_FILE ]]
+      then
+        report=`echo "$report" | jq --arg signature $(echo "$report" | jq -S -c . | tr -d '\n' | openssl dgst -sha256 -hmac "$(cat $SIGNING_KEY_FILE)" | awk '{print $NF}') '.signature = $signature'`
+      fi
+      echo "$report"
+      ;;
+    csv)
+      report=`echo "$report" | jq -r '
+        (["record", "secret", "namespace", "state", "time", "detail"]),
+        (.secrets[] | .name as $name | .lastChanged as $changed | .namespaces[] | ["copy", $name, .namespace, .state, .synced, "content changed \($changed // "unknown")"]),
+        (.drift[] | ["drift", .name, .namespace, .type, null, null]),
+        (.tamperEvents[] | ["tamper", null, null, .reason, .time, .message])
+        | @csv'`
+      echo "$report"
+      if [[ -n $SIGNING_KEY_FILE ]]
+      then
+        echo "# hmac-sha256 $(echo "$report" | openssl dgst -sha256 -hmac "$(cat $SIGNING_KEY_FILE)" | awk '{print $NF}')"
+      fi
+      ;;
+    *)
+      log-error "Unknown output format: $output (json or csv)"
+      exit 1
+      ;;
+  esac
+  if [[ -z $SIGNING_KEY_FILE ]]
+  then
+    log-warn "SIGNING_KEY_FILE isn't set, the report is not signed"
+  fi
+}
+
+## An exec probe for images without curl or wget: either the health file the
+## loop rewrites on every namespace check (every wait tick with fleet output),
+## every namespace the mass-change check renders and every publish is recent
+## enough, or with --endpoint an HTTP GET over bash's /dev/tcp returns a 2xx.
+check-health() {
+  local max_age=300
+  local endpoint
+  while [[ $# -gt 0 ]]
+  do
+    case $1 in
+      --max-age)
+        max_age=$2
+        shift 2
+        ;;
+      --max-age=*)
+        max_age=${1#*=}
+        shift
+        ;;
+      --endpoint)
+        endpoint=$2
+        shift 2
+        ;;
+      --endpoint=*)
+        endpoint=${1#*=}
+        shift
+        ;;
+      *)
+        log-error "Unknown option: $1"
+        exit 1
+        ;;
+    esac
+  done
+  if [[ -n $endpoint ]]
+  then
+    if [[ ! $endpoint =~ ^http://([^/:]+)(:([0-9]+))?(/.*)?$ ]]
+    then
+      log-error "Need an http://host[:port]/path endpoint"
+      exit 1
+    fi
+    local host=${BASH_REMATCH[1]} port=${BASH_REMATCH[3]:-80} path=${BASH_REMATCH[4]:-/} response
+    if ! { exec 3<> /dev/tcp/${host}/${port}; } 2> /dev/null
+    then
+      log-error "Unhealthy: can't connect to ${endpoint}"
+      exit 1
+    fi
+    printf 'GET %s HTTP/1.0\r\nHost: %s\r\n\r\n' "$path" "$host" >&3
+    read -r -t 5 response <&3
+    exec 3<&-
+    if [[ ! $response =~ ^HTTP/[0-9.]+\ 2[0-9][0-9] ]]
+    then
+      log-error "Unhealthy: ${endpoint} answered ${response:-nothing}"
+      exit 1
+    fi
+    return
+  fi
+  local files=($HEALTH_FILE)
+  if [[ -n $SYNC_PROFILES_DIR ]]
+  then
+    files=()
+    for profile in `ls ${SYNC_PROFILES_DIR}`
+    do
+      files+=(${WORK_DIR}/push-to-k8s-${profile}.health)
+    done
+  fi
+  for file in "${files[@]}"
+  do
+    if [[ ! -f $file ]]
+    then
+      log-error "Unhealthy: ${file} doesn't exist yet"
+      exit 1
+    fi
+    local age=$(( `date -u +%s` - `date -u -r $file +%s` ))
+    if (( age > max_age ))
+    then
+      log-error "Unhealthy: ${file} was last updated ${age} seconds ago"
+      exit 1
     fi
   done
-  cleanup-tmp-dir
-  sleep ${SLEEP}
-done
\ No newline at end of file
+}
+
+help() {
+  cat <<EOF
+Usage: main.sh [command] [options]
+
+Pushes the objects labeled push-to-k8s=source in the source namespace to all
+selected namespaces.
+
+Commands:
+  (none)                Run the sync loop
+  rbac                  Print the minimal RBAC for the current settings
+  sign KIND NAME [NAMESPACE]
+                        Sign a source object with SIGNING_KEY_FILE
+  status [-o FORMAT]    Print the published status as table, json or yaml;
+                        exits 0 in sync, 1 on drift, 2 on failing namespaces,
+                        3 on configuration or kubectl errors
+  report [-o FORMAT]    Print the sync state of every source in every
+                        namespace as table, json or csv
+  compliance-report [-o FORMAT]
+                        Print a signed audit report as json or csv
+  health [--max-age S]  Exit 1 unless the loop updated its health file within
+         [--endpoint URL] S seconds (300), or an HTTP GET of URL returns 2xx
+  completion SHELL      Print the completion script for bash, zsh or fish
+  help                  Show this help
+
+Options:
+  -q, --quiet           Only log errors
+  -v, -vv               Log debug messages, or trace every command
+
+Settings are read from environment variables, see the README.
+EOF
+}
+
+## Completion only covers the subcommands and status formats; options are
+## environment variables.
+completion() {
+  case $1 in
+    bash)
+      cat <<'EOF'
+_push_to_k8s() {
+  local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+  case $prev in
+    -o|--output)
+      if [[ ${COMP_WORDS[1]} == report ]]; then
+        COMPREPLY=($(compgen -W "table json csv" -- "$cur"))
+      elif [[ ${COMP_WORDS[1]} == compliance-report ]]; then
+        COMPREPLY=($(compgen -W "json csv" -- "$cur"))
+      else
+        COMPREPLY=($(compgen -W "table json yaml" -- "$cur"))
+      fi
+      return ;;
+    completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;
+    status|report|compliance-report) COMPREPLY=($(compgen -W "--output" -- "$cur")); return ;;
+    health) COMPREPLY=($(compgen -W "--max-age --endpoint" -- "$cur")); return ;;
+  esac
+  if [[ $COMP_CWORD -eq 1 ]]; then
+    COMPREPLY=($(compgen -W "rbac sign status report compliance-report health completion help" -- "$cur"))
+  fi
+}
+complete -F _push_to_k8s main.sh
+EOF
+      ;;
+    zsh)
+      cat <<'EOF'
+#compdef main.sh
+_arguments \
+  '1:command:(rbac sign status report compliance-report health completion help)' \
+  '*::arg:->args'
+case $words[1] in
+  status) _arguments '(-o --output)'{-o,--output}'[output format]:format:(table json yaml)' ;;
+  report) _arguments '(-o --output)'{-o,--output}'[output format]:format:(table json csv)' ;;
+  compliance-report) _arguments '(-o --output)'{-o,--output}'[output format]:format:(json csv)' ;;
+  health) _arguments '--max-age[seconds]:seconds:' '--endpoint[URL]:url:' ;;
+  completion) _arguments '1:shell:(bash zsh fish)' ;;
+esac
+EOF
+      ;;
+    fish)
+      cat <<'EOF'
+complete -c main.sh -f
+complete -c main.sh -n __fish_use_subcommand -a rbac -d 'Print the minimal RBAC'
+complete -c main.sh -n __fish_use_subcommand -a sign -d 'Sign a source object'
+complete -c main.sh -n __fish_use_subcommand -a status -d 'Print the published status'
+complete -c main.sh -n __fish_use_subcommand -a report -d 'Print the sync state of every source'
+complete -c main.sh -n __fish_use_subcommand -a compliance-report -d 'Print a signed audit report'
+complete -c main.sh -n __fish_use_subcommand -a health -d 'Check the health of the sync loop'
+complete -c main.sh -n __fish_use_subcommand -a completion -d 'Print a completion script'
+complete -c main.sh -n __fish_use_subcommand -a help -d 'Show help'
+complete -c main.sh -n '__fish_seen_subcommand_from status' -s o -l output -xa 'table json yaml'
+complete -c main.sh -n '__fish_seen_subcommand_from report' -s o -l output -xa 'table json csv'
+complete -c main.sh -n '__fish_seen_subcommand_from compliance-report' -s o -l output -xa 'json csv'
+complete -c main.sh -n '__fish_seen_subcommand_from health' -l max-age -l endpoint -x
+complete -c main.sh -n '__fish_seen_subcommand_from completion' -xa 'bash zsh fish'
+EOF
+      ;;
+    *)
+      log-error "Usage: main.sh completion bash|zsh|fish"
+      exit 1
+      ;;
+  esac
+}
+
+args=()
+for arg in "$@"
+do
+  case $arg in
+    -q|--quiet)
+      LOG_LEVEL=error
+      ;;
+    -v)
+      LOG_LEVEL=debug
+      ;;
+    -vv)
+      LOG_LEVEL=trace
+      ;;
+    *)
+      args+=("$arg")
+      ;;
+  esac
+done
+set -- "${args[@]}"
+
+## Sourcing the script, as tests/run.sh does, only defines the functions.
+if [[ ! ${BASH_SOURCE[0]} == $0 ]]
+then
+  return
+fi
+
+case $1 in
+  help|-h|--help)
+    help
+    ;;
+  completion)
+    completion $2
+    ;;
+  rbac)
+    setup
+    print-rbac
+    ;;
+  sign)
+    setup
+    if [[ -z $SIGNING_KEY_FILE ]] || [[ -z $3 ]]
+    then
+      log-error "Usage: SIGNING_KEY_FILE=<file> main.sh sign <kind> <name> [namespace]"
+      exit 1
+    fi
+    sign-source $2 $3 $4
+    ;;
+  status)
+    # 1 and 2 report drift and failing namespaces, so a broken configuration
+    # needs a code of its own.
+    CONFIG_EXIT_CODE=3
+    setup
+    shift
+    print-status "$@"
+    ;;
+  health)
+    setup-paths
+    shift
+    check-health "$@"
+    ;;
+  report)
+    setup
+    shift
+    print-report "$@"
+    ;;
+  compliance-report)
+    setup
+    shift
+    print-compliance-report "$@"
+    ;;
+  *)
+    if [[ -n $SYNC_PROFILES_DIR ]]
+    then
+      run-profiles
+    else
+      supervise
+    fi
+    ;;
+esac
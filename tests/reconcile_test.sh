@@ -0,0 +1,69 @@
+## Every trigger goes through reconcile-namespace: new namespaces are pushed
+## regardless of the write window, retried and bootstrapped, the periodic sync
+## and re-selected namespaces only within the window and without bootstrap.
+
+stub-reconcile() {
+  CALLS=${TMPDIR}/calls
+  push-to-namespace() { echo "push $1" >> $CALLS; return ${PUSH_RESULT:-0}; }
+  bootstrap-namespace() { echo "bootstrap $1" >> $CALLS; }
+  retry-with-backoff() { "$@"; }
+  queue-retry() { echo "retry $1 $2" >> $CALLS; }
+  count-namespace() { echo "count $1 $2" >> $CALLS; }
+  in-write-window() { [[ $WINDOW == "open" ]]; }
+}
+
+test-new-namespace-pushed-outside-write-window() {
+  stub-reconcile
+  WINDOW=closed
+  reconcile-namespace team-a new
+  assert-equals "push team-a,bootstrap team-a,count team-a 0" "`paste -s -d , $CALLS`"
+}
+
+test-new-namespace-failure-is-retried-and-bootstrapped() {
+  stub-reconcile
+  WINDOW=open
+  PUSH_RESULT=1
+  assert-fails reconcile-namespace team-a new
+  assert-equals "push team-a,retry team-a 1,bootstrap team-a,count team-a 1" "`paste -s -d , $CALLS`"
+}
+
+test-periodic-skipped-outside-write-window() {
+  stub-reconcile
+  WINDOW=closed
+  reconcile-namespace team-a periodic
+  assert-fails [ -s $CALLS ]
+  assert-equals skipped "${SYNC_NAMESPACES[team-a]}"
+}
+
+test-periodic-failure-is-retried() {
+  stub-reconcile
+  WINDOW=open
+  PUSH_RESULT=1
+  assert-fails reconcile-namespace team-a periodic
+  assert-equals "push team-a,retry team-a 1,count team-a 1" "`paste -s -d , $CALLS`"
+}
+
+test-retry-success-clears-queue() {
+  stub-reconcile
+  WINDOW=open
+  RETRY_QUEUE[team-a]=1
+  reconcile-namespace team-a retry
+  assert-equals "push team-a,count team-a 0" "`paste -s -d , $CALLS`"
+  assert-equals "" "${RETRY_QUEUE[team-a]}"
+}
+
+test-reselected-namespace-uses-periodic-trigger() {
+  stub-reconcile
+  reconcile-namespace() { echo "reconcile $1 $2" >> $CALLS; }
+  list-namespaces() { echo team-a; echo team-b; echo team-c; }
+  for function in check-namespace-lists record-health record-skipped-namespaces clean-up-namespaces record-namespace-events observe-histogram
+  do
+    eval "${function}() { :; }"
+  done
+  printf 'selected team-a null\nselected team-b null\nselected team-c 2026-01-01T00:00:00Z\n' > ${STATEDIR}/namespace-rules
+  KNOWN_NAMESPACES=team-a
+  ALL_NAMESPACES=`printf 'team-a\nteam-b\n'`
+  NEW_NAMESPACE_POLL=0
+  sync-new-namespaces
+  assert-equals "reconcile team-b periodic,reconcile team-c new" "`paste -s -d , $CALLS`"
+}
@@ -0,0 +1,43 @@
+## A source's secret type or immutability changing must reach the copies:
+## the type can't be updated in place, so the copy is deleted and created
+## again, and both fields are part of the hashes copies are compared by.
+
+source-secret() {
+  jq -n --arg name $1 --arg type $2 '{kind: "Secret", metadata: {name: $name}, type: $type, data: {key: "dmFsdWU="}}'
+}
+
+test-recreate-secret-whose-type-changed() {
+  source-secret tls kubernetes.io/tls | jq -s '{kind: "List", items: .}' > ${TMPDIR}/manifest.json
+  source-secret tls Opaque | jq -s '{kind: "List", items: .}' > $KUBECTL_GET
+  recreate-changed-types team-a ${TMPDIR}/manifest.json
+  assert-called "^-n team-a delete secret tls$"
+}
+
+test-keep-secret-whose-type-matches() {
+  { source-secret plain Opaque; source-secret tls kubernetes.io/tls; } | jq -s '{kind: "List", items: .}' > ${TMPDIR}/manifest.json
+  { source-secret plain Opaque | jq 'del(.type)'; source-secret tls kubernetes.io/tls; } | jq -s '{kind: "List", items: .}' > $KUBECTL_GET
+  recreate-changed-types team-a ${TMPDIR}/manifest.json
+  assert-not-called "delete"
+}
+
+test-ignore-secrets-without-a-source() {
+  source-secret tls kubernetes.io/tls | jq -s '{kind: "List", items: .}' > ${TMPDIR}/manifest.json
+  source-secret users-own Opaque | jq -s '{kind: "List", items: .}' > $KUBECTL_GET
+  recreate-changed-types team-a ${TMPDIR}/manifest.json
+  assert-not-called "delete"
+}
+
+test-content-hash-covers-type-and-immutable() {
+  local plain=`source-secret creds Opaque | content-hashes`
+  assert-equals $plain "`source-secret creds Opaque | content-hashes`" "the hash isn't stable"
+  assert-fails [ $plain == "`source-secret creds kubernetes.io/basic-auth | content-hashes`" ]
+  assert-fails [ $plain == "`source-secret creds Opaque | jq '.immutable = true' | content-hashes`" ]
+}
+
+test-copy-with-other-type-is-applied() {
+  source-secret creds kubernetes.io/basic-auth | jq -s '{kind: "List", items: .}' | hash-copies > ${TMPDIR}/manifest.json
+  source-secret creds Opaque | jq -s '{kind: "List", items: .}' | hash-copies > ${TMPDIR}/existing-team-a.json
+  assert-equals 1 `drop-unchanged team-a ${TMPDIR}/manifest.json | jq '.items | length'` "the copy with the old type was left out"
+  cp ${TMPDIR}/manifest.json ${TMPDIR}/existing-team-a.json
+  assert-equals 0 `drop-unchanged team-a ${TMPDIR}/manifest.json | jq '.items | length'` "an up to date copy was applied"
+}
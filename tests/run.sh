@@ -0,0 +1,88 @@
+#!/bin/bash
+
+## Runs the test-* functions of every tests/*_test.sh (or of the files given)
+## against the functions of main.sh, each in its own subshell with fresh state
+## directories and tests/kubectl in place of kubectl. Needs bash and jq only.
+cd `dirname $0`/..
+export PATH=`pwd`/tests/bin:$PATH
+source ./main.sh
+
+## Fails the current test with a message unless the two values are equal.
+assert-equals() {
+  if [[ ! $1 == $2 ]]
+  then
+    echo "    expected: $1"
+    echo "    actual:   $2"
+    echo "    ${3:-values differ}"
+    exit 1
+  fi
+}
+
+## Fails unless the command succeeds (or, with assert-fails, fails).
+assert-succeeds() {
+  if ! "$@"
+  then
+    echo "    expected success: $*"
+    exit 1
+  fi
+}
+
+assert-fails() {
+  if "$@"
+  then
+    echo "    expected failure: $*"
+    exit 1
+  fi
+}
+
+## Fails unless kubectl was (or wasn't) called with arguments matching the
+## extended regex.
+assert-called() {
+  if ! grep -qE -- "$1" $KUBECTL_LOG
+  then
+    echo "    expected a kubectl call matching: $1"
+    sed 's/^/    called: /' $KUBECTL_LOG
+    exit 1
+  fi
+}
+
+assert-not-called() {
+  if grep -qE -- "$1" $KUBECTL_LOG
+  then
+    echo "    unexpected kubectl call: `grep -E -- "$1" $KUBECTL_LOG | head -n 1`"
+    exit 1
+  fi
+}
+
+run-test() {
+  (
+    TMPDIR=`mktemp -d`
+    STATEDIR=`mktemp -d`
+    mkdir -p ${TMPDIR}/source ${STATEDIR}/status ${STATEDIR}/approved ${STATEDIR}/metrics ${STATEDIR}/checksums ${STATEDIR}/counters
+    export KUBECTL_LOG=${TMPDIR}/kubectl.log
+    export KUBECTL_GET=${TMPDIR}/kubectl-get.json
+    : > $KUBECTL_LOG
+    trap "rm -rf ${TMPDIR} ${STATEDIR}" EXIT
+    ( $1 ) > ${TMPDIR}/test.log 2>&1 || { cat ${TMPDIR}/test.log; exit 1; }
+  )
+}
+
+results=`mktemp`
+trap "rm -f ${results}" EXIT
+for file in ${@:-tests/*_test.sh}
+do
+  (
+    source $file
+    for test in `declare -F | awk '$3 ~ /^test-/ {print $3}'`
+    do
+      if run-test $test
+      then
+        echo "ok   ${file##*/} ${test}"
+      else
+        echo "FAIL ${file##*/} ${test}"
+      fi
+    done
+  )
+done | tee $results
+echo "`grep -c '^ok' $results` passed, `grep -c '^FAIL' $results` failed"
+! grep -q '^FAIL' $results
@@ -0,0 +1,108 @@
+## With WATCH_SOURCES a source change starts the next sync once the sources
+## were left alone for SOURCE_SYNC_DEBOUNCE seconds and no sooner than
+## SOURCE_SYNC_MIN_INTERVAL after the last sync started.
+
+stub-watch() {
+  source-fingerprint() { [[ -n $FINGERPRINT ]] && echo $FINGERPRINT; }
+  WATCH_SOURCES=true
+  SOURCE_POLL=0
+  SOURCE_SYNC_DEBOUNCE=10
+  SOURCE_SYNC_MIN_INTERVAL=0
+  SOURCE_FINGERPRINT=a
+  FINGERPRINT=a
+  LAST_SOURCE_POLL=0
+  SYNC_STARTED_AT=0
+  SECONDS=100
+}
+
+test-unchanged-sources-dont-start-a-sync() {
+  stub-watch
+  assert-fails sources-changed
+  SECONDS=200
+  assert-fails sources-changed
+}
+
+test-change-waits-for-debounce() {
+  stub-watch
+  FINGERPRINT=b
+  assert-fails sources-changed
+  SECONDS=105
+  assert-fails sources-changed
+  SECONDS=110
+  assert-succeeds sources-changed
+}
+
+test-further-edits-restart-debounce() {
+  stub-watch
+  FINGERPRINT=b
+  assert-fails sources-changed
+  SECONDS=105
+  FINGERPRINT=c
+  assert-fails sources-changed
+  SECONDS=111
+  assert-fails sources-changed
+  SECONDS=115
+  assert-succeeds sources-changed
+}
+
+test-change-waits-for-min-interval() {
+  stub-watch
+  SOURCE_SYNC_DEBOUNCE=0
+  SOURCE_SYNC_MIN_INTERVAL=60
+  SYNC_STARTED_AT=90
+  FINGERPRINT=b
+  assert-fails sources-changed
+  SECONDS=150
+  assert-succeeds sources-changed
+}
+
+test-polls-no-more-often-than-source-poll() {
+  stub-watch
+  SOURCE_SYNC_DEBOUNCE=0
+  SOURCE_POLL=30
+  LAST_SOURCE_POLL=90
+  FINGERPRINT=b
+  assert-fails sources-changed
+  SECONDS=120
+  assert-succeeds sources-changed
+}
+
+test-failed-fingerprint-doesnt-start-a-sync() {
+  stub-watch
+  SOURCE_SYNC_DEBOUNCE=0
+  FINGERPRINT=""
+  assert-fails sources-changed
+}
+
+test-disabled-without-watch-sources() {
+  stub-watch
+  WATCH_SOURCES=false
+  SOURCE_SYNC_DEBOUNCE=0
+  FINGERPRINT=b
+  assert-fails sources-changed
+}
+
+test-count-coalesced-changes() {
+  stub-watch
+  FINGERPRINT=b
+  sources-changed
+  FINGERPRINT=c
+  sources-changed
+  FINGERPRINT=d
+  sources-changed
+  assert-equals 2 `get-counter source-changes-coalesced`
+}
+
+test-count-seconds-waiting-for-min-interval() {
+  stub-watch
+  SOURCE_SYNC_MIN_INTERVAL=60
+  SYNC_STARTED_AT=90
+  FINGERPRINT=b
+  sources-changed
+  SECONDS=120
+  assert-fails sources-changed
+  SECONDS=150
+  assert-succeeds sources-changed
+  assert-equals 40 `get-counter source-sync-rate-limited`
+  assert-equals 0 `get-counter source-changes-coalesced`
+}